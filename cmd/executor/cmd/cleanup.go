@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newCleanupCmd(driverName func() (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "cleanup",
+		Short: "Remove the current executor",
+		Long:  "",
+		Run: func(cmd *cobra.Command, args []string) {
+			e, err := newExecutor(driverName)
+			if err != nil {
+				exitOnError(nil, err, "Error creating executor")
+			}
+			defer e.Close()
+			err = e.CleanUp()
+			if err != nil {
+				exitOnError(e, err, "Error cleaning up executor")
+			}
+		},
+	}
+}
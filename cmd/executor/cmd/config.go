@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newConfigCmd(driverName func() (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "config",
+		Short: "Print the job configuration for the custom executor",
+		Long:  "",
+		Run: func(cmd *cobra.Command, args []string) {
+			e, err := newExecutor(driverName)
+			if err != nil {
+				exitOnError(nil, err, "Error creating executor")
+			}
+			err = e.Config()
+			if err != nil {
+				exitOnError(e, err, "Error generating executor config")
+			}
+		},
+	}
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	executor "github.com/juanfont/gitlab-machine"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/naming"
+	"github.com/juanfont/gitlab-machine/pkg/pool"
+	"github.com/juanfont/gitlab-machine/pkg/provision"
+	"github.com/juanfont/gitlab-machine/pkg/sizing"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+
+	// drivers register themselves
+	_ "github.com/juanfont/gitlab-machine/pkg/drivers/docker"
+	_ "github.com/juanfont/gitlab-machine/pkg/drivers/libvirt"
+	_ "github.com/juanfont/gitlab-machine/pkg/drivers/vcd"
+)
+
+// newStageCommands returns the commands of the custom executor stages.
+// driverName is called once the config has been read.
+func newStageCommands(driverName func() (string, error)) []*cobra.Command {
+	return []*cobra.Command{
+		newConfigCmd(driverName),
+		newPrepareCmd(driverName),
+		newRunCmd(driverName),
+		newCleanupCmd(driverName),
+		newShellCmd(driverName),
+	}
+}
+
+// newDriverCmd keeps the old per-driver command groups working,
+// e.g. executor vcd prepare
+func newDriverCmd(name string) *cobra.Command {
+	c := &cobra.Command{
+		Use:   name,
+		Short: fmt.Sprintf("Manage %s gitlab-machine driver", name),
+	}
+	driverName := func() (string, error) {
+		return name, nil
+	}
+	c.AddCommand(newStageCommands(driverName)...)
+	c.AddCommand(newGCCmd(driverName))
+	return c
+}
+
+// resolveDriverName picks the driver from the --driver flag, the driver key
+// of the config, or the only driver configured
+func resolveDriverName() (string, error) {
+	if driverFlag != "" {
+		return driverFlag, nil
+	}
+	if name := viper.GetString("driver"); name != "" {
+		return name, nil
+	}
+
+	configured := viper.GetStringMap("drivers")
+	if len(configured) == 1 {
+		for name := range configured {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no driver selected, use --driver or set driver in the config (available: %v)", drivers.Names())
+}
+
+func newExecutor(driverName func() (string, error)) (*executor.Executor, error) {
+	name, err := driverName()
+	if err != nil {
+		return nil, err
+	}
+
+	names := naming.Config{}
+	if err := viper.UnmarshalKey("naming", &names); err != nil {
+		return nil, err
+	}
+	vars := naming.JobVariables()
+	machineName, err := names.MachineName(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := func(guestOS drivers.OStype) (string, error) {
+		return names.Hostname(vars, guestOS)
+	}
+
+	e, err := newDriverExecutor(name, machineName, hostname, getStateStore())
+	if err != nil {
+		return nil, err
+	}
+
+	// pool machines have the size and template set in the config
+	hasTemplates := len(viper.GetStringMap(fmt.Sprintf("drivers.%s.templates", name))) > 0
+	if viper.GetInt(fmt.Sprintf("drivers.%s.pool.size", name)) > 0 && !sizing.Requested() && drivers.RequestedTemplate(hasTemplates) == "" {
+		e.UsePool(getPool(), name)
+	}
+	return e, nil
+}
+
+// newDriverExecutor creates the driver and its executor. hostname renders the
+// guest hostname for drivers that set it, nil keeps the one of the image.
+func newDriverExecutor(name string, machineName string, hostname func(drivers.OStype) (string, error), store *state.Store) (*executor.Executor, error) {
+	d, err := drivers.New(name, viper.Sub(fmt.Sprintf("drivers.%s", name)), machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if h, ok := d.(drivers.Hostnamer); ok && hostname != nil {
+		guestHostname, err := hostname(h.GuestOS())
+		if err != nil {
+			return nil, err
+		}
+		h.SetHostname(guestHostname)
+	}
+
+	provisionKey := fmt.Sprintf("drivers.%s.provision", name)
+	if p, ok := d.(drivers.Profiled); ok && p.ProvisionProfile() != "" {
+		provisionKey = fmt.Sprintf("drivers.%s.provision_profiles.%s", name, p.ProvisionProfile())
+		if !viper.IsSet(provisionKey) {
+			return nil, fmt.Errorf("unknown provisioning profile %q", p.ProvisionProfile())
+		}
+	}
+
+	provisioning := provision.Config{}
+	if err := viper.UnmarshalKey(provisionKey, &provisioning); err != nil {
+		return nil, err
+	}
+
+	return executor.NewExecutor(d, store, provisioning)
+}
+
+// getStateStore returns the store for the state of the current job, or nil
+// when we are not running under GitLab
+func getStateStore() *state.Store {
+	jobID := os.Getenv("CUSTOM_ENV_CI_JOB_ID")
+	if jobID == "" {
+		return nil
+	}
+	return state.NewStore(viper.GetString("state_dir"), jobID)
+}
+
+func getPool() *pool.Pool {
+	return pool.New(filepath.Join(viper.GetString("state_dir"), "pool.json"))
+}
+
+// exitOnError logs err, closes c when set, as os.Exit skips the deferred
+// Close, and terminates the process with the exit code GitLab expects for
+// that kind of failure
+func exitOnError(c io.Closer, err error, msg string) {
+	log.Error().Err(err).Msg(msg)
+	if c != nil {
+		c.Close()
+	}
+	os.Exit(executor.ExitCode(err))
+}
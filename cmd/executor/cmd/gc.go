@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/gitlab"
+	"github.com/juanfont/gitlab-machine/pkg/pool"
+)
+
+const defaultGCTTL = 24 * time.Hour
+
+func newGCCmd(driverName func() (string, error)) *cobra.Command {
+	var (
+		dryRun bool
+		ttl    time.Duration
+	)
+
+	c := &cobra.Command{
+		Use:   "gc",
+		Short: "Destroy the machines left behind by failed cleanups",
+		Long: `Lists the machines created by gitlab-machine and destroys the ones older than
+the TTL. When gc.gitlab_url and gc.gitlab_token are configured, machines whose
+job is still running are kept regardless of their age.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			name, err := driverName()
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error selecting driver")
+			}
+
+			d, err := drivers.New(name, viper.Sub(fmt.Sprintf("drivers.%s", name)), "")
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error creating driver")
+			}
+			collector, ok := d.(drivers.Collector)
+			if !ok {
+				log.Fatal().Msgf("Driver %s does not support garbage collection", name)
+			}
+
+			if !cmd.Flags().Changed("ttl") {
+				ttl = viper.GetDuration("gc.ttl")
+			}
+			if ttl == 0 {
+				ttl = defaultGCTTL
+			}
+
+			var gl *gitlab.Client
+			if url := viper.GetString("gc.gitlab_url"); url != "" {
+				gl = gitlab.NewClient(url, viper.GetString("gc.gitlab_token"))
+			}
+
+			pooled, err := pooledMachines()
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error reading the pool")
+			}
+
+			if err := collectGarbage(collector, ttl, gl, pooled, dryRun); err != nil {
+				log.Fatal().Err(err).Msg("Error collecting garbage")
+			}
+		},
+	}
+
+	c.Flags().BoolVar(&dryRun, "dry-run", false, "only report what would be destroyed")
+	c.Flags().DurationVar(&ttl, "ttl", defaultGCTTL, "age after which a machine is considered orphaned")
+	return c
+}
+
+// pooledMachines returns the names of the ready machines in the pool
+func pooledMachines() (map[string]bool, error) {
+	machines, err := getPool().List()
+	if err != nil {
+		return nil, err
+	}
+
+	pooled := map[string]bool{}
+	for _, m := range machines {
+		pooled[m.Name] = true
+	}
+	return pooled, nil
+}
+
+func collectGarbage(collector drivers.Collector, ttl time.Duration, gl *gitlab.Client, pooled map[string]bool, dryRun bool) error {
+	machines, err := collector.ListMachines()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tAGE\tJOB\tACTION")
+
+	for _, m := range machines {
+		age := time.Since(m.CreatedAt).Round(time.Second)
+		action := gcAction(m, age, ttl, gl, pooled[m.Name])
+
+		if action == "destroy" {
+			if dryRun {
+				action = "destroy (dry run)"
+			} else if err := collector.DestroyMachine(m); err != nil {
+				log.Error().Err(err).Msgf("Error destroying %s", m.Name)
+				action = "destroy failed"
+			} else {
+				action = "destroyed"
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Name, age, m.JobID, action)
+	}
+
+	return w.Flush()
+}
+
+// gcAction decides whether a machine is orphaned. Machines ready in the pool
+// belong to the pool daemon, and machines of running jobs are still in use.
+// Pool machines not in the pool anymore were left behind by a crashed daemon
+// or a failed adoption, and age like the others.
+func gcAction(m drivers.Machine, age time.Duration, ttl time.Duration, gl *gitlab.Client, pooled bool) string {
+	if pooled {
+		return "keep (pool)"
+	}
+	if age < ttl {
+		return "keep"
+	}
+	// no job to ask GitLab about
+	if strings.HasPrefix(m.Name, pool.MachinePrefix) {
+		return "destroy"
+	}
+
+	if gl != nil && m.ProjectID != "" && m.JobID != "" {
+		status, err := gl.JobStatus(m.ProjectID, m.JobID)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Error getting the status of job %s, keeping %s", m.JobID, m.Name)
+			return "keep (unknown job status)"
+		}
+		if gitlab.IsActive(status) {
+			return fmt.Sprintf("keep (job %s)", status)
+		}
+	}
+
+	return "destroy"
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/pool"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+)
+
+const defaultPoolRefillInterval = 30 * time.Second
+
+var poolCmd = &cobra.Command{
+	Use:   "pool",
+	Short: "Keep a pool of ready machines that prepare can claim",
+	Long: `Runs until interrupted, keeping pool.size provisioned machines of the selected
+driver ready. prepare claims one of them and renames it after the job, instead
+of creating a new machine. Claimed machines are destroyed after the job.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		name, err := resolveDriverName()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error selecting driver")
+		}
+
+		size := viper.GetInt(fmt.Sprintf("drivers.%s.pool.size", name))
+		if size < 1 {
+			log.Fatal().Msgf("drivers.%s.pool.size must be set to run the pool", name)
+		}
+
+		d, err := drivers.New(name, viper.Sub(fmt.Sprintf("drivers.%s", name)), "")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error creating driver")
+		}
+		if _, ok := d.(drivers.Adopter); !ok {
+			log.Fatal().Msgf("Driver %s does not support pools", name)
+		}
+
+		interval := viper.GetDuration(fmt.Sprintf("drivers.%s.pool.refill_interval", name))
+		if interval == 0 {
+			interval = defaultPoolRefillInterval
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		m := pool.NewManager(getPool(), name, size, interval, func(machineName string) (*state.JobState, error) {
+			return createPoolMachine(name, machineName)
+		})
+		if err := m.Run(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Error running the pool")
+		}
+	},
+}
+
+// createPoolMachine creates and provisions a machine like prepare does, but
+// without a job to keep its state for. Any job can claim it, so it keeps the
+// hostname of the image.
+func createPoolMachine(driverName string, machineName string) (*state.JobState, error) {
+	e, err := newDriverExecutor(driverName, machineName, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer e.Close()
+
+	if err := e.Prepare(); err != nil {
+		if cleanupErr := e.CleanUp(); cleanupErr != nil {
+			log.Warn().Err(cleanupErr).Msgf("Error removing failed pool machine %s", machineName)
+		}
+		return nil, err
+	}
+
+	return e.State(), nil
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func newPrepareCmd(driverName func() (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "prepare",
+		Short: "Prepare a new instance of the executor",
+		Long:  "",
+		Run: func(cmd *cobra.Command, args []string) {
+			e, err := newExecutor(driverName)
+			if err != nil {
+				exitOnError(nil, err, "Error creating executor")
+			}
+			defer e.Close()
+
+			err = e.Prepare()
+			if err != nil {
+				exitOnError(e, err, "Error preparing executor")
+			}
+		},
+	}
+}
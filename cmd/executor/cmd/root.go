@@ -9,22 +9,30 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
-	vcdcmd "github.com/juanfont/gitlab-machine/cmd/executor/cmd/vcd"
+	executor "github.com/juanfont/gitlab-machine"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-const version = "0.1"
-
-var cfgFile string
+var (
+	cfgFile    string
+	driverFlag string
+)
 
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file path")
+	rootCmd.PersistentFlags().StringVar(&driverFlag, "driver", "", "driver to use (defaults to the driver set in the config)")
 
 	rootCmd.AddCommand(versionCmd)
-	rootCmd.AddCommand(vcdcmd.VcdCmd)
+	rootCmd.AddCommand(poolCmd)
+	rootCmd.AddCommand(newGCCmd(resolveDriverName))
+	rootCmd.AddCommand(newStageCommands(resolveDriverName)...)
+	for _, name := range drivers.Names() {
+		rootCmd.AddCommand(newDriverCmd(name))
+	}
 }
 
 func Execute() {
@@ -50,6 +58,7 @@ func initConfig() {
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
+	viper.SetDefault("state_dir", filepath.Join(os.TempDir(), "gitlab-machine"))
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err != nil {
@@ -57,8 +66,9 @@ func initConfig() {
 	}
 
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
+	// stdout is reserved for the job output and the config stage JSON
 	log.Logger = log.Output(zerolog.ConsoleWriter{
-		Out:        os.Stdout,
+		Out:        os.Stderr,
 		TimeFormat: time.RFC3339,
 		NoColor:    false,
 	})
@@ -80,7 +90,7 @@ var versionCmd = &cobra.Command{
 	Short: "Print the version.",
 	Long:  "The version of the executor.",
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println(version)
+		fmt.Println(executor.Version)
 	},
 }
 
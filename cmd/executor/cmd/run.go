@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newRunCmd(driverName func() (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "run PATH STAGE",
+		Short: "Run phase of the custom executor",
+		Long:  "",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 2 {
+				return fmt.Errorf("missing parameters")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			e, err := newExecutor(driverName)
+			if err != nil {
+				exitOnError(nil, err, "Error creating executor")
+			}
+			defer e.Close()
+
+			// GitLab sends SIGTERM when the job is cancelled or times out
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			ctx, cancelTimeout := withJobTimeout(ctx)
+			defer cancelTimeout()
+
+			err = e.Run(ctx, args[0], args[1])
+			if err != nil {
+				exitOnError(e, err, "Error running the command")
+			}
+		},
+	}
+}
+
+// withJobTimeout bounds ctx by the timeout of the job, in case the runner
+// does not stop us in time
+func withJobTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	seconds, err := strconv.Atoi(os.Getenv("CUSTOM_ENV_CI_JOB_TIMEOUT"))
+	if err != nil || seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newShellCmd(driverName func() (string, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "shell cmd",
+		Short: "Opens a shell with the specified command",
+		Long:  "",
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) < 1 {
+				return fmt.Errorf("missing parameters")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			e, err := newExecutor(driverName)
+			if err != nil {
+				exitOnError(nil, err, "Error creating executor")
+			}
+			defer e.Close()
+			err = e.Shell(args[0])
+			if err != nil {
+				exitOnError(e, err, "Error creating executor")
+			}
+		},
+	}
+}
@@ -1,88 +1,237 @@
 package executor
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"strconv"
+	"time"
 
-	"github.com/dimchansky/utfbom"
 	"github.com/rs/zerolog/log"
 
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
 	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/pool"
+	"github.com/juanfont/gitlab-machine/pkg/provision"
+	"github.com/juanfont/gitlab-machine/pkg/state"
 )
 
+const Version = "0.1"
+
+const (
+	buildFailureExitCodeEnv  = "BUILD_FAILURE_EXIT_CODE"
+	systemFailureExitCodeEnv = "SYSTEM_FAILURE_EXIT_CODE"
+	defaultFailureExitCode   = 1
+)
+
+// ConfigOutput is the document the config stage hands back to GitLab
+type ConfigOutput struct {
+	BuildsDir         string            `json:"builds_dir"`
+	CacheDir          string            `json:"cache_dir"`
+	BuildsDirIsShared bool              `json:"builds_dir_is_shared"`
+	Hostname          string            `json:"hostname"`
+	Driver            DriverInfo        `json:"driver"`
+	JobEnv            map[string]string `json:"job_env,omitempty"`
+}
+
+type DriverInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
 type Executor struct {
-	driver drivers.Driver
+	driver       drivers.Driver
+	store        *state.Store
+	provisioning provision.Config
+	pool         *pool.Pool
+	poolKey      string
 }
 
-func NewExecutor(d drivers.Driver) (*Executor, error) {
+// NewExecutor restores the job state saved by prepare into the driver.
+// A nil store disables the persistence of the job state.
+func NewExecutor(d drivers.Driver, store *state.Store, provisioning provision.Config) (*Executor, error) {
+	if err := provisioning.Validate(); err != nil {
+		return nil, err
+	}
+
 	e := Executor{}
 	e.driver = d
+	e.store = store
+	e.provisioning = provisioning
+
+	if t, ok := d.(drivers.Tagger); ok {
+		t.SetMetadata(jobMetadata())
+	}
+
+	if sd, ok := d.(drivers.Stateful); ok && store != nil {
+		st, err := store.Load()
+		if err != nil && !errors.Is(err, state.ErrStateNotFound) {
+			return nil, drivers.NewSystemFailure(err)
+		}
+		if st != nil {
+			sd.RestoreState(st)
+		}
+	}
+
 	return &e, nil
 }
 
-// Prepare calls the driver to ready up a new execution environment
-func (e *Executor) Prepare() error {
-	err := e.driver.Create()
+// ExitCode maps an error returned by the Executor to the exit code GitLab
+// expects from the custom executor. Unclassified errors are system failures.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if drivers.IsBuildFailure(err) {
+		return exitCodeFromEnv(buildFailureExitCodeEnv)
+	}
+	return exitCodeFromEnv(systemFailureExitCodeEnv)
+}
+
+func exitCodeFromEnv(name string) int {
+	code, err := strconv.Atoi(os.Getenv(name))
 	if err != nil {
-		return err
+		log.Warn().Str("variable", name).Msg("Exit code not provided by GitLab, using default")
+		return defaultFailureExitCode
 	}
+	return code
+}
 
-	log.Info().Msg("Setting up base software")
-	if os, _ := e.driver.GetOS(); os == drivers.Windows {
-		pw := `powershell New-ItemProperty -Path "HKLM:\SOFTWARE\OpenSSH" -Name DefaultShell -Value "C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe" -PropertyType String -Force`
-		err = e.runCommand(pw, false)
-		if err != nil {
-			return err
-		}
+// jobMetadata describes the job from the variables GitLab passes to the executor
+func jobMetadata() map[string]string {
+	metadata := map[string]string{
+		drivers.MetadataCreatedAt: time.Now().UTC().Format(time.RFC3339),
+		drivers.MetadataVersion:   Version,
+	}
 
-		err = e.runCommand("choco install -y --no-progress git.install;", false)
-		if err != nil {
-			return err
+	for key, env := range map[string]string{
+		drivers.MetadataJobID:       "CUSTOM_ENV_CI_JOB_ID",
+		drivers.MetadataPipelineID:  "CUSTOM_ENV_CI_PIPELINE_ID",
+		drivers.MetadataProjectID:   "CUSTOM_ENV_CI_PROJECT_ID",
+		drivers.MetadataProjectPath: "CUSTOM_ENV_CI_PROJECT_PATH",
+		drivers.MetadataRunnerID:    "CUSTOM_ENV_CI_RUNNER_ID",
+		drivers.MetadataCommitSHA:   "CUSTOM_ENV_CI_COMMIT_SHA",
+	} {
+		if value := os.Getenv(env); value != "" {
+			metadata[key] = value
 		}
+	}
+	return metadata
+}
 
-		err = e.runCommand("refreshenv;", false)
-		if err != nil {
-			return err
-		}
+// UsePool makes Prepare claim a ready machine from the pool before creating a new one
+func (e *Executor) UsePool(p *pool.Pool, key string) {
+	e.pool = p
+	e.poolKey = key
+}
 
-		err = e.runCommand("choco install -y --no-progress poshgit;", false)
-		if err != nil {
-			return err
-		}
+// Config prints the job configuration expected by the config stage of the custom executor
+func (e *Executor) Config() error {
+	cfg := ConfigOutput{
+		BuildsDir:         e.driver.GetBuildsDir(),
+		CacheDir:          e.driver.GetCacheDir(),
+		BuildsDirIsShared: false, // every job gets its own machine
+		Hostname:          e.driver.GetMachineName(),
+		Driver: DriverInfo{
+			Name:    fmt.Sprintf("gitlab-machine %s", e.driver.GetDriverName()),
+			Version: Version,
+		},
+		JobEnv: map[string]string{
+			"GITLAB_MACHINE_NAME":   e.driver.GetMachineName(),
+			"GITLAB_MACHINE_DRIVER": e.driver.GetDriverName(),
+		},
+	}
 
-		err = e.runCommand("choco install -y --no-progress gitlab-runner;", false)
-		if err != nil {
-			return err
-		}
+	out, err := json.Marshal(cfg)
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+	fmt.Printf("%s\n", out)
+	return nil
+}
 
-		err = e.runCommand("Restart-Service -force sshd", false) // https://github.com/chocolatey/choco/issues/2694
-		if err != nil {
-			return err
-		}
+// Prepare calls the driver to ready up a new execution environment
+func (e *Executor) Prepare() error {
+	adopted, err := e.adoptFromPool()
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+	if adopted {
+		// pool machines are provisioned before being added to the pool
+		return drivers.NewSystemFailure(e.saveState())
 	}
 
-	return nil
+	err = e.driver.Create()
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	err = e.saveState()
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	log.Info().Msg("Setting up base software")
+	machineOS, err := e.driver.GetOS()
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	engine, err := provision.NewEngine(e.driver)
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	err = engine.Run(e.provisioning.StepsFor(machineOS))
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	// the host key is pinned on the first connection, which may be the
+	// provisioning one
+	return drivers.NewSystemFailure(e.saveState())
 }
 
-// Run executes the required script
-func (e *Executor) Run(filePath string, stage string) error {
-	data, err := os.ReadFile(filePath)
+// Run uploads the stage script to the machine and executes it. When ctx is
+// done, e.g. GitLab cancelled the job, the processes of the script are killed.
+func (e *Executor) Run(ctx context.Context, filePath string, stage string) error {
+	machineOS, err := e.driver.GetOS()
 	if err != nil {
-		return err
+		return drivers.NewSystemFailure(err)
 	}
 
-	reader, _ := utfbom.Skip(bytes.NewReader(data))
-	buf, err := io.ReadAll(reader)
+	c, err := e.driver.GetCommunicator()
 	if err != nil {
-		return err
+		return drivers.NewSystemFailure(err)
+	}
+
+	remotePath := remoteScriptPath(machineOS, e.driver.GetMachineName(), stage)
+	err = c.Upload(filePath, remotePath)
+	if err != nil {
+		return drivers.NewSystemFailure(err)
 	}
+	defer func() {
+		dir := path.Dir(remotePath)
+		if err := e.runCommand(removeDirCommand(machineOS, dir)); err != nil {
+			log.Warn().Err(err).Str("path", dir).Msg("Error removing the stage scripts")
+		}
+	}()
 
 	log.Debug().Msgf("Starting stage on %s %s (%s)", e.driver.GetMachineName(), stage, filePath)
-	err = e.runCommand(string(buf), true)
+	err = e.streamCommand(ctx, scriptCommand(machineOS, remotePath))
+	if ctx.Err() != nil {
+		log.Warn().Err(ctx.Err()).Msgf("Stage %s interrupted, killing its processes", stage)
+		if err := e.runCommand(killCommand(machineOS, remotePath)); err != nil {
+			log.Error().Err(err).Msg("Error killing the stage processes")
+		}
+		return drivers.NewSystemFailure(ctx.Err())
+	}
 	if err != nil {
-		return err
+		return classifyScriptError(err)
 	}
 
 	return nil
@@ -91,42 +240,174 @@ func (e *Executor) Run(filePath string, stage string) error {
 // Cleanup releases the resources once the job has finished
 func (e *Executor) CleanUp() error {
 	err := e.driver.Destroy()
-	return err
+	if err != nil {
+		return drivers.NewSystemFailure(err)
+	}
+
+	if e.store != nil {
+		return drivers.NewSystemFailure(e.store.Delete())
+	}
+	return nil
+}
+
+// Close releases the connection to the machine, for drivers that keep one
+func (e *Executor) Close() error {
+	if c, ok := e.driver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 // Shell opens a shell with the specified command
 func (e *Executor) Shell(cmd string) error {
-	client, err := e.driver.GetSSHClientFromDriver()
+	c, err := e.driver.GetCommunicator()
 	if err != nil {
-		return err
+		return drivers.NewSystemFailure(err)
+	}
+	return classifyScriptError(c.Shell(cmd))
+}
+
+// State returns what the driver knows about its machine, or nil if the
+// driver does not keep any state
+func (e *Executor) State() *state.JobState {
+	sd, ok := e.driver.(drivers.Stateful)
+	if !ok {
+		return nil
+	}
+
+	st := state.JobState{
+		Driver:      e.driver.GetDriverName(),
+		MachineName: e.driver.GetMachineName(),
+	}
+	sd.SaveState(&st)
+	return &st
+}
+
+func (e *Executor) saveState() error {
+	st := e.State()
+	if st == nil || e.store == nil {
+		return nil
+	}
+
+	log.Debug().Msg("Saving job state")
+	return e.store.Save(st)
+}
+
+// adoptFromPool claims a ready machine from the pool, if there is one. A
+// machine that cannot be adopted is destroyed, and a new one is created.
+func (e *Executor) adoptFromPool() (bool, error) {
+	adopter, ok := e.driver.(drivers.Adopter)
+	if !ok || e.pool == nil {
+		return false, nil
+	}
+
+	m, err := e.pool.Claim(e.poolKey)
+	if errors.Is(err, pool.ErrPoolEmpty) {
+		log.Info().Msg("No ready machine in the pool, creating a new one")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	log.Info().Msgf("Claimed %s from the pool", m.Name)
+	if err := adopter.Adopt(&m.State); err != nil {
+		// the machine is out of the pool already, nobody else would destroy it
+		log.Error().Err(err).Msgf("Error adopting %s, destroying it and creating a new one", m.Name)
+		if err := e.driver.Destroy(); err != nil {
+			log.Error().Err(err).Msgf("Error destroying %s, gc will collect it", m.Name)
+		}
+		adopter.RestoreState(&state.JobState{})
+		return false, nil
+	}
+	return true, nil
+}
+
+// remoteScriptPath returns where the script of a stage is uploaded to. Scripts
+// of different jobs never share a directory.
+func remoteScriptPath(machineOS drivers.OStype, machineName, stage string) string {
+	if machineOS == drivers.Windows {
+		// PowerShell refuses to run scripts without the .ps1 extension
+		return fmt.Sprintf("C:/gitlab-machine/%s/%s.ps1", machineName, stage)
+	}
+	return fmt.Sprintf("/tmp/gitlab-machine/%s/%s.sh", machineName, stage)
+}
+
+func scriptCommand(machineOS drivers.OStype, remotePath string) string {
+	if machineOS == drivers.Windows {
+		return fmt.Sprintf("powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -File %s", remotePath)
+	}
+	return fmt.Sprintf("bash %s", remotePath)
+}
+
+// killCommand kills the process trees running the script at remotePath
+func killCommand(machineOS drivers.OStype, remotePath string) string {
+	return drivers.KillCommand(machineOS, remotePath)
+}
+
+// removeDirCommand removes the directory of the stage scripts. The default
+// SSH shell of Windows guests may be cmd.exe, hence the explicit PowerShell.
+func removeDirCommand(machineOS drivers.OStype, dir string) string {
+	if machineOS == drivers.Windows {
+		return drivers.PowerShellCommand(fmt.Sprintf("Remove-Item -Recurse -Force -ErrorAction SilentlyContinue '%s'", dir))
+	}
+	return fmt.Sprintf("rm -rf '%s'", dir)
+}
+
+// classifyScriptError marks a remote command exiting with a non-zero status
+// as a build failure. Any other error means we could not reach the machine.
+func classifyScriptError(err error) error {
+	if err == nil {
+		return nil
 	}
-	return client.Shell(cmd)
+	if _, ok := communicator.ExitStatus(err); ok {
+		return drivers.NewBuildFailure(err)
+	}
+	return drivers.NewSystemFailure(err)
 }
 
-func (e *Executor) runCommand(command string, printOutput bool) error {
-	client, err := e.driver.GetSSHClientFromDriver()
+func (e *Executor) runCommand(command string) error {
+	c, err := e.driver.GetCommunicator()
 	if err != nil {
 		return err
 	}
 
 	log.Debug().Str("command", command).Msg("Running command")
 
-	output, err := client.Output(command)
+	output, err := communicator.Output(context.Background(), c, command)
 	if err != nil {
 		log.Error().
 			Err(err).
 			Str("command", command).
 			Str("output", string(output)).
 			Msg("Error running command")
-		return fmt.Errorf("ssh command error")
+		return fmt.Errorf("remote command error: %w", err)
+	}
+
+	log.Debug().Str("output", output).Msg("Command executed successfully")
+
+	return nil
+}
+
+// streamCommand runs the command copying its output to ours while it runs,
+// so long jobs show progress in the GitLab job log
+func (e *Executor) streamCommand(ctx context.Context, command string) error {
+	c, err := e.driver.GetCommunicator()
+	if err != nil {
+		return err
 	}
 
-	if printOutput {
-		fmt.Printf("%s", output)
-		log.Debug().Msg("Command executed successfully")
-	} else {
-		log.Debug().Str("output", output).Msg("Command executed successfully")
+	log.Debug().Str("command", command).Msg("Running command")
+
+	err = c.Run(ctx, command, os.Stdout, os.Stderr)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("command", command).
+			Msg("Error running command")
+		return fmt.Errorf("remote command error: %w", err)
 	}
 
+	log.Debug().Msg("Command executed successfully")
 	return nil
 }
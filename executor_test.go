@@ -0,0 +1,211 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/provision"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+)
+
+// exitError is a command exiting with a non-zero status
+type exitError struct {
+	status int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("Process exited with status %d", e.status)
+}
+
+func (e *exitError) ExitStatus() int {
+	return e.status
+}
+
+// fakeCommunicator records the commands run on it. run decides how each of
+// them ends, they succeed without it.
+type fakeCommunicator struct {
+	run func(ctx context.Context, command string) error
+
+	mu       sync.Mutex
+	commands []string
+	uploads  []string
+	// hostKey is pinned by the first command, like SSH does
+	hostKey string
+}
+
+func (c *fakeCommunicator) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	c.mu.Lock()
+	c.commands = append(c.commands, command)
+	if c.hostKey == "" {
+		c.hostKey = "ssh-ed25519 AAAA"
+	}
+	c.mu.Unlock()
+
+	if c.run == nil {
+		return nil
+	}
+	return c.run(ctx, command)
+}
+
+func (c *fakeCommunicator) Upload(localPath, remotePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploads = append(c.uploads, remotePath)
+	return nil
+}
+
+func (c *fakeCommunicator) Download(remotePath, localPath string) error {
+	return nil
+}
+
+func (c *fakeCommunicator) Shell(args ...string) error {
+	return nil
+}
+
+func (c *fakeCommunicator) Close() error {
+	return nil
+}
+
+func (c *fakeCommunicator) ran(prefix string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, command := range c.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeDriver is a Linux machine reached over a fakeCommunicator
+type fakeDriver struct {
+	comm    *fakeCommunicator
+	created bool
+}
+
+var _ drivers.Stateful = (*fakeDriver)(nil)
+
+func (d *fakeDriver) Create() error {
+	d.created = true
+	return nil
+}
+
+func (d *fakeDriver) Destroy() error                  { return nil }
+func (d *fakeDriver) GetDriverName() string           { return "fake" }
+func (d *fakeDriver) GetMachineName() string          { return "machine" }
+func (d *fakeDriver) GetOS() (drivers.OStype, error)  { return drivers.Linux, nil }
+func (d *fakeDriver) GetBuildsDir() string            { return "/builds" }
+func (d *fakeDriver) GetCacheDir() string             { return "/cache" }
+func (d *fakeDriver) RestoreState(st *state.JobState) {}
+func (d *fakeDriver) GetCommunicator() (communicator.Communicator, error) {
+	return d.comm, nil
+}
+
+func (d *fakeDriver) SaveState(st *state.JobState) {
+	st.SSHHostKey = d.comm.hostKey
+}
+
+func TestRunMapsExitCodes(t *testing.T) {
+	t.Setenv(buildFailureExitCodeEnv, "11")
+	t.Setenv(systemFailureExitCodeEnv, "12")
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, 0},
+		{"script failed", &exitError{status: 3}, 11},
+		{"connection lost", errors.New("connection reset by peer"), 12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &fakeDriver{comm: &fakeCommunicator{
+				run: func(ctx context.Context, command string) error {
+					if strings.HasPrefix(command, "bash ") {
+						return tc.err
+					}
+					return nil
+				},
+			}}
+			e, err := NewExecutor(d, nil, provision.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = e.Run(context.Background(), "script.sh", "build_script")
+			if got := ExitCode(err); got != tc.want {
+				t.Errorf("exit code = %d, want %d (%v)", got, tc.want, err)
+			}
+			if !d.comm.ran("rm -rf '/tmp/gitlab-machine/machine'") {
+				t.Error("the stage scripts were not removed")
+			}
+		})
+	}
+}
+
+func TestRunKillsScriptOnCancel(t *testing.T) {
+	d := &fakeDriver{comm: &fakeCommunicator{
+		run: func(ctx context.Context, command string) error {
+			if strings.HasPrefix(command, "bash ") {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		},
+	}}
+	e, err := NewExecutor(d, nil, provision.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = e.Run(ctx, "script.sh", "build_script")
+
+	var sf *drivers.SystemFailure
+	if !errors.As(err, &sf) {
+		t.Fatalf("error = %v, want a system failure", err)
+	}
+	remotePath := remoteScriptPath(drivers.Linux, "machine", "build_script")
+	if !d.comm.ran(killCommand(drivers.Linux, remotePath)) {
+		t.Error("the processes of the script were not killed")
+	}
+}
+
+func TestPrepareProvisionsAndSavesState(t *testing.T) {
+	d := &fakeDriver{comm: &fakeCommunicator{}}
+	store := state.NewStore(t.TempDir(), "1")
+	e, err := NewExecutor(d, store, provision.Config{
+		Linux: []provision.Step{{Name: "Say hello", Run: "echo hello"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.created {
+		t.Error("the machine was not created")
+	}
+	if !d.comm.ran("echo hello") {
+		t.Error("the provisioning step did not run")
+	}
+
+	// the host key is pinned while provisioning, after the first save
+	st, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SSHHostKey != d.comm.hostKey {
+		t.Errorf("saved host key = %q, want %q", st.SSHHostKey, d.comm.hostKey)
+	}
+}
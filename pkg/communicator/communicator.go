@@ -0,0 +1,71 @@
+package communicator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Communicator runs commands and copies files on a machine, over whatever
+// transport the driver reaches it with (SSH, WinRM...)
+type Communicator interface {
+	// Run runs the command until it exits or ctx is done, copying its
+	// standard output and standard error to the given writers as they are
+	// produced. A non-zero exit status is returned as an error ExitStatus
+	// understands.
+	Run(ctx context.Context, command string, stdout, stderr io.Writer) error
+
+	// Upload copies the local file to remotePath, creating the parent
+	// directories if needed
+	Upload(localPath, remotePath string) error
+	// Download copies the remote file to localPath
+	Download(remotePath, localPath string) error
+
+	// Shell runs the command, or the default shell without one, attached
+	// to our terminal
+	Shell(args ...string) error
+
+	// Close closes the connection to the machine. Commands run afterwards
+	// connect again.
+	Close() error
+}
+
+// Output runs the command, returning its standard output and standard error
+// combined
+func Output(ctx context.Context, c Communicator, command string) (string, error) {
+	var output bytes.Buffer
+	w := &syncWriter{w: &output}
+	err := c.Run(ctx, command, w, w)
+	return output.String(), err
+}
+
+// exitError is implemented by the errors of commands exiting with a
+// non-zero status, like the ones of golang.org/x/crypto/ssh
+type exitError interface {
+	error
+	ExitStatus() int
+}
+
+// ExitStatus returns the remote exit status carried by err, if the error
+// was caused by the remote command exiting with a non-zero status
+func ExitStatus(err error) (int, bool) {
+	var exitErr exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), true
+	}
+	return 0, false
+}
+
+// syncWriter serializes the writes of stdout and stderr to the same writer
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
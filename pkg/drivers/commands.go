@@ -0,0 +1,46 @@
+package drivers
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"unicode/utf16"
+)
+
+// KillCommand kills the process trees whose command line contains marker,
+// which must not contain single quotes
+func KillCommand(machineOS OStype, marker string) string {
+	if machineOS == Windows {
+		script := fmt.Sprintf(
+			"Get-CimInstance Win32_Process | Where-Object { $_.CommandLine -and $_.CommandLine.Contains('%s') } | "+
+				"ForEach-Object { taskkill /PID $_.ProcessId /T /F }",
+			marker,
+		)
+		// encoded, so the command line of the killer does not match itself
+		return PowerShellCommand(script)
+	}
+
+	// sshd starts every command in its own session, so killing the process
+	// group of a match kills whatever it started. The brackets keep pgrep
+	// from matching the shell running this command.
+	pattern := "[" + regexp.QuoteMeta(marker[:1]) + "]" + regexp.QuoteMeta(marker[1:])
+	return fmt.Sprintf(
+		"pgids=$(for pid in $(pgrep -f '%s'); do ps -o pgid= -p $pid; done); "+
+			"for g in $pgids; do pkill -TERM -g $g; done; "+
+			"[ -z \"$pgids\" ] || sleep 5; "+
+			"for g in $pgids; do pkill -KILL -g $g; done; true",
+		pattern,
+	)
+}
+
+// PowerShellCommand runs script in PowerShell, whatever the default shell of
+// the guest is
+func PowerShellCommand(script string) string {
+	u := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return fmt.Sprintf("powershell -NoProfile -NonInteractive -EncodedCommand %s", base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,247 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	apiVersion = "v1.41"
+)
+
+// apiClient is a minimal client of the Docker Engine API, covering only
+// what the driver needs
+type apiClient struct {
+	http *http.Client
+	base string
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+type hostConfig struct {
+	PortBindings map[string][]portBinding `json:"PortBindings,omitempty"`
+	Privileged   bool                     `json:"Privileged,omitempty"`
+}
+
+type containerConfig struct {
+	Image        string              `json:"Image"`
+	Hostname     string              `json:"Hostname,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   hostConfig          `json:"HostConfig"`
+}
+
+type containerInspect struct {
+	ID    string `json:"Id"`
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Ports map[string][]portBinding `json:"Ports"`
+	} `json:"NetworkSettings"`
+}
+
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// newAPIClient connects to the daemon listening on the unix socket of host
+// (unix:///var/run/docker.sock)
+func newAPIClient(host string) (*apiClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	c := apiClient{
+		http: &http.Client{
+			Timeout: 10 * time.Minute, // pulling images takes a while
+		},
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}
+		c.base = "http://docker"
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q", host)
+	}
+
+	return &c, nil
+}
+
+func (c *apiClient) imageExists(image string) (bool, error) {
+	err := c.do(http.MethodGet, fmt.Sprintf("/images/%s/json", image), nil, nil, nil)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (c *apiClient) pullImage(image string) error {
+	// without a tag, the API pulls every tag of the repository
+	name, tag := splitImage(image)
+	q := url.Values{}
+	q.Set("fromImage", name)
+	q.Set("tag", tag)
+
+	resp, err := c.request(http.MethodPost, "/images/create", q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the progress is streamed as JSON messages, failures included
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("error pulling %s: %s", image, msg.Error)
+		}
+	}
+}
+
+// splitImage splits an image reference into its name and its tag or digest,
+// defaulting to latest. Colons before the last slash belong to the registry.
+func splitImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+	return image, "latest"
+}
+
+func (c *apiClient) createContainer(name string, cfg containerConfig) (string, error) {
+	q := url.Values{}
+	q.Set("name", name)
+
+	var out struct {
+		ID string `json:"Id"`
+	}
+	if err := c.do(http.MethodPost, "/containers/create", q, cfg, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+func (c *apiClient) startContainer(id string) error {
+	return c.do(http.MethodPost, fmt.Sprintf("/containers/%s/start", id), nil, nil, nil)
+}
+
+func (c *apiClient) inspectContainer(id string) (*containerInspect, error) {
+	out := containerInspect{}
+	if err := c.do(http.MethodGet, fmt.Sprintf("/containers/%s/json", id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+func (c *apiClient) renameContainer(id string, name string) error {
+	q := url.Values{}
+	q.Set("name", name)
+	return c.do(http.MethodPost, fmt.Sprintf("/containers/%s/rename", id), q, nil, nil)
+}
+
+func (c *apiClient) removeContainer(id string) error {
+	q := url.Values{}
+	q.Set("force", "true")
+	q.Set("v", "true")
+	return c.do(http.MethodDelete, fmt.Sprintf("/containers/%s", id), q, nil, nil)
+}
+
+// do sends the request with body encoded as JSON, and decodes the response into out
+func (c *apiClient) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	resp, err := c.request(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *apiClient) request(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := fmt.Sprintf("%s/%s%s", c.base, apiVersion, path)
+	if len(query) > 0 {
+		u = fmt.Sprintf("%s?%s", u, query.Encode())
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := apiError{}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, &statusError{code: resp.StatusCode, message: apiErr.Message}
+	}
+
+	return resp, nil
+}
+
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("docker API error (%d): %s", e.code, e.message)
+}
+
+func isNotFound(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && se.code == http.StatusNotFound
+}
@@ -0,0 +1,35 @@
+package docker
+
+import (
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+func init() {
+	drivers.Register(DriverName, newFromConfig)
+}
+
+func newFromConfig(v *viper.Viper, machineName string) (drivers.Driver, error) {
+	cfg := DockerDriverConfig{
+		Host:       v.GetString("host"),
+		Image:      v.GetString("image"),
+		Command:    v.GetStringSlice("command"),
+		User:       v.GetString("user"),
+		Password:   v.GetString("password"),
+		Privileged: v.GetBool("privileged"),
+		BuildsDir:  v.GetString("builds_dir"),
+		CacheDir:   v.GetString("cache_dir"),
+	}
+
+	if err := v.UnmarshalKey("wait", &cfg.Waits); err != nil {
+		return nil, err
+	}
+	if cfg.Host != "" && !strings.HasPrefix(cfg.Host, "unix://") {
+		return nil, ErrRemoteHost
+	}
+
+	return NewDockerDriver(cfg, machineName)
+}
@@ -0,0 +1,270 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/ssh"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
+
+const (
+	DriverName = "docker"
+	sshPort    = "22/tcp"
+
+	ErrContainerNotFound = utils.Error("container not found")
+	ErrNoSSHPort         = utils.Error("SSH port of the container is not published")
+	ErrRemoteHost        = utils.Error("only local docker daemons are supported, set host to a unix:// socket")
+)
+
+type DockerDriverConfig struct {
+	// Host is the unix socket of a local daemon, unix:///var/run/docker.sock
+	// by default. The SSH port of the containers is published on 127.0.0.1,
+	// so remote daemons cannot work.
+	Host       string
+	Image      string // must run sshd
+	Command    []string
+	User       string
+	Password   string
+	Privileged bool
+
+	BuildsDir string
+	CacheDir  string
+
+	// overrides the defaults of the waits (ssh)
+	Waits wait.Configs
+}
+
+type DockerDriver struct {
+	cfg         DockerDriverConfig
+	client      *apiClient
+	machineName string
+	hostname    string
+	ContainerID string
+	sshPort     int
+	hostKey     string
+	comm        drivers.CommunicatorCache
+	createdAt   time.Time
+}
+
+func NewDockerDriver(cfg DockerDriverConfig, machineName string) (*DockerDriver, error) {
+	if cfg.Host == "" {
+		cfg.Host = "unix:///var/run/docker.sock"
+	}
+	if cfg.User == "" {
+		cfg.User = "root"
+	}
+
+	c, err := newAPIClient(cfg.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	d := DockerDriver{
+		cfg:         cfg,
+		client:      c,
+		machineName: machineName,
+	}
+	return &d, nil
+}
+
+func (d *DockerDriver) GetDriverName() string {
+	return DriverName
+}
+
+func (d *DockerDriver) GetMachineName() string {
+	return d.machineName
+}
+
+func (d *DockerDriver) WaitConfig(name string) wait.Config {
+	return d.cfg.Waits[name]
+}
+
+func (d *DockerDriver) GuestOS() drivers.OStype {
+	return drivers.Linux
+}
+
+func (d *DockerDriver) SetHostname(hostname string) {
+	d.hostname = hostname
+}
+
+func (d *DockerDriver) GetOS() (drivers.OStype, error) {
+	return drivers.Linux, nil
+}
+
+func (d *DockerDriver) GetBuildsDir() string {
+	if d.cfg.BuildsDir != "" {
+		return d.cfg.BuildsDir
+	}
+	return drivers.DefaultBuildsDir(drivers.Linux)
+}
+
+func (d *DockerDriver) GetCacheDir() string {
+	if d.cfg.CacheDir != "" {
+		return d.cfg.CacheDir
+	}
+	return drivers.DefaultCacheDir(drivers.Linux)
+}
+
+func (d *DockerDriver) SaveState(st *state.JobState) {
+	st.ContainerID = d.ContainerID
+	st.SSHPort = d.sshPort
+	st.OS = string(drivers.Linux)
+	st.AdminPassword = d.cfg.Password
+	st.SSHHostKey = d.hostKey
+	st.CreatedAt = d.createdAt
+}
+
+func (d *DockerDriver) RestoreState(st *state.JobState) {
+	d.ContainerID = st.ContainerID
+	d.sshPort = st.SSHPort
+	if st.AdminPassword != "" {
+		d.cfg.Password = st.AdminPassword
+	}
+	d.hostKey = st.SSHHostKey
+	d.createdAt = st.CreatedAt
+}
+
+func (d *DockerDriver) Adopt(st *state.JobState) error {
+	d.RestoreState(st)
+
+	log.Info().Msgf("Renaming container %s to %s", d.ContainerID, d.machineName)
+	return d.client.renameContainer(d.ContainerID, d.machineName)
+}
+
+func (d *DockerDriver) Create() error {
+	log.Info().Msgf("Creating a new container %s", d.machineName)
+	d.createdAt = time.Now()
+
+	exists, err := d.client.imageExists(d.cfg.Image)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		log.Info().Msgf("Pulling image %s", d.cfg.Image)
+		if err := d.client.pullImage(d.cfg.Image); err != nil {
+			return err
+		}
+	}
+
+	id, err := d.client.createContainer(d.machineName, containerConfig{
+		Image:        d.cfg.Image,
+		Hostname:     d.hostname,
+		Cmd:          d.cfg.Command,
+		Labels:       map[string]string{"created-by": "gitlab-machine"},
+		ExposedPorts: map[string]struct{}{sshPort: {}},
+		HostConfig: hostConfig{
+			// let docker pick a free port, we read it back after starting
+			PortBindings: map[string][]portBinding{
+				sshPort: {{HostIP: "127.0.0.1", HostPort: ""}},
+			},
+			Privileged: d.cfg.Privileged,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	d.ContainerID = id
+
+	log.Info().Msgf("Starting container %s", d.machineName)
+	if err := d.client.startContainer(id); err != nil {
+		return err
+	}
+
+	if _, err := d.getSSHPort(); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Waiting for SSH to be available")
+	err = drivers.WaitForCommunicator(context.Background(), d)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msg("SSH is available")
+	return nil
+}
+
+func (d *DockerDriver) GetCommunicator() (communicator.Communicator, error) {
+	return d.comm.Get(d.openCommunicator)
+}
+
+func (d *DockerDriver) openCommunicator() (communicator.Communicator, error) {
+	auth := ssh.Auth{
+		Passwords: []string{d.cfg.Password},
+		HostKey:   d.hostKey,
+		OnHostKey: func(hostKey string) { d.hostKey = hostKey },
+	}
+
+	port, err := d.getSSHPort()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.NewClient(d.cfg.User, "127.0.0.1", port, &auth)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes the connection to the machine, if there is one
+func (d *DockerDriver) Close() error {
+	return d.comm.Close()
+}
+
+func (d *DockerDriver) Destroy() error {
+	_ = d.Close()
+
+	id := d.ContainerID
+	if id == "" {
+		id = d.machineName // the container name works as well
+	}
+
+	log.Info().Msgf("Removing container %s", d.machineName)
+	err := d.client.removeContainer(id)
+	if isNotFound(err) {
+		return ErrContainerNotFound
+	}
+	return err
+}
+
+func (d *DockerDriver) getSSHPort() (int, error) {
+	if d.sshPort != 0 {
+		return d.sshPort, nil
+	}
+
+	id := d.ContainerID
+	if id == "" {
+		id = d.machineName
+	}
+
+	c, err := d.client.inspectContainer(id)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, ErrContainerNotFound
+		}
+		return 0, err
+	}
+	d.ContainerID = c.ID
+
+	bindings := c.NetworkSettings.Ports[sshPort]
+	if len(bindings) < 1 {
+		return 0, ErrNoSSHPort
+	}
+
+	port, err := strconv.Atoi(bindings[0].HostPort)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SSH port %q: %w", bindings[0].HostPort, err)
+	}
+	d.sshPort = port
+	return port, nil
+}
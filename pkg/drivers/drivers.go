@@ -1,6 +1,13 @@
 package drivers
 
-import "github.com/juanfont/gitlab-machine/pkg/ssh"
+import (
+	"regexp"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
 
 type OStype string
 
@@ -12,7 +19,111 @@ const (
 type Driver interface {
 	Create() error
 	Destroy() error
+	GetDriverName() string
 	GetMachineName() string
 	GetOS() (OStype, error)
-	GetSSHClientFromDriver() (ssh.Client, error)
+	GetBuildsDir() string
+	GetCacheDir() string
+	// GetCommunicator returns how to run commands and copy files on the
+	// machine. It is kept open until the driver is closed.
+	GetCommunicator() (communicator.Communicator, error)
+}
+
+// Stateful drivers keep what they learn about their machine in prepare,
+// so the following stages do not have to look it up again
+type Stateful interface {
+	SaveState(st *state.JobState)
+	RestoreState(st *state.JobState)
+}
+
+// Adopters can take over a ready machine from the pool, which was created
+// under another name, and rename it after the job
+type Adopter interface {
+	Stateful
+	Adopt(st *state.JobState) error
+}
+
+// Keys of the metadata that Taggers attach to their machines
+const (
+	MetadataJobID       = "gitlab-machine.job-id"
+	MetadataPipelineID  = "gitlab-machine.pipeline-id"
+	MetadataProjectID   = "gitlab-machine.project-id"
+	MetadataProjectPath = "gitlab-machine.project-path"
+	MetadataRunnerID    = "gitlab-machine.runner-id"
+	MetadataCommitSHA   = "gitlab-machine.commit-sha"
+	MetadataCreatedAt   = "gitlab-machine.created-at" // RFC 3339
+	MetadataVersion     = "gitlab-machine.version"
+)
+
+// Taggers attach the job metadata to the machines they create, and can use
+// it to find them again
+type Tagger interface {
+	SetMetadata(metadata map[string]string)
+}
+
+// Hostnamers set the hostname of the guest when creating the machine
+type Hostnamer interface {
+	// GuestOS returns the OS whose naming rules the hostname must follow.
+	// It is called before the machine exists.
+	GuestOS() OStype
+	SetHostname(hostname string)
+}
+
+// Profiled drivers can provision their machines with a profile other than
+// the default one, from provision_profiles in their config. Empty means the
+// default profile.
+type Profiled interface {
+	ProvisionProfile() string
+}
+
+// Waiters let the waits for their machines (ssh, rdp...) be configured.
+// Unset fields of the returned config keep their defaults.
+type Waiter interface {
+	WaitConfig(name string) wait.Config
+}
+
+// Machine is a machine created by gitlab-machine, as listed by a Collector
+type Machine struct {
+	// ID tells the machine apart from the ones with the same name (vApp
+	// HREF...). Only the driver that listed it understands it.
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	ProjectID string // empty when unknown
+	JobID     string // empty when unknown
+}
+
+// Collectors can list the machines they created, so the ones left behind
+// by a crashed runner or a failed cleanup can be garbage-collected
+type Collector interface {
+	ListMachines() ([]Machine, error)
+	DestroyMachine(m Machine) error
+}
+
+// the concurrent ID may be missing, older names collapsed it with its hyphen
+var machineNameRegexp = regexp.MustCompile(`-project-(\d+)-concurrent(?:-\d+)?-job-(\d+)$`)
+
+// ParseMachineName extracts the project and job IDs from a machine name
+func ParseMachineName(name string) (projectID string, jobID string) {
+	m := machineNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return "", ""
+	}
+	return m[1], m[2]
+}
+
+// DefaultBuildsDir returns where jobs are checked out on a machine with the given OS
+func DefaultBuildsDir(os OStype) string {
+	if os == Windows {
+		return `C:\builds`
+	}
+	return "/builds"
+}
+
+// DefaultCacheDir returns where the job cache is kept on a machine with the given OS
+func DefaultCacheDir(os OStype) string {
+	if os == Windows {
+		return `C:\cache`
+	}
+	return "/cache"
 }
@@ -0,0 +1,55 @@
+package drivers
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BuildFailure wraps errors caused by the job itself, such as a script
+// exiting with a non-zero status. GitLab reports them as a failed job.
+type BuildFailure struct {
+	Err error
+}
+
+func (e *BuildFailure) Error() string {
+	return fmt.Sprintf("build failure: %s", e.Err)
+}
+
+func (e *BuildFailure) Unwrap() error {
+	return e.Err
+}
+
+// SystemFailure wraps errors caused by the infrastructure (vCD API, SSH dial,
+// provisioning...). GitLab treats them as retriable.
+type SystemFailure struct {
+	Err error
+}
+
+func (e *SystemFailure) Error() string {
+	return fmt.Sprintf("system failure: %s", e.Err)
+}
+
+func (e *SystemFailure) Unwrap() error {
+	return e.Err
+}
+
+func NewBuildFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &BuildFailure{Err: err}
+}
+
+func NewSystemFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SystemFailure{Err: err}
+}
+
+// IsBuildFailure reports whether err was caused by the job itself.
+// Errors that are not classified are considered system failures.
+func IsBuildFailure(err error) bool {
+	var b *BuildFailure
+	return errors.As(err, &b)
+}
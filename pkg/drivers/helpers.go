@@ -1,76 +1,134 @@
 package drivers
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
 	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
 	"github.com/rs/zerolog/log"
 )
 
 const (
-	ErrExecutingSSHCommand  = utils.Error("error executing SSH command")
-	ErrTooManyRetriesForSSH = utils.Error("too many retries waiting for SSH to be available")
+	ErrExecutingCommand = utils.Error("error executing remote command")
 )
 
-// From github.com/docker/machine/libmachine
-
-func sshAvailableFunc(d Driver) func() bool {
-	return func() bool {
-		log.Debug().Msg("Getting to WaitForSSH function...")
+// CI variables jobs use to pick a template
+const (
+	TemplateVariable = "CUSTOM_ENV_GITLAB_MACHINE_TEMPLATE"
+	ImageVariable    = "CUSTOM_ENV_CI_JOB_IMAGE"
+)
 
-		if _, err := runSSHCommandFromDriver(d, "exit"); err != nil {
-			log.Debug().Err(err).Msgf("Error getting ssh command 'exit'")
-			return false
-		}
-		return true
+// RequestedTemplate returns the alias of the template the job asked for with
+// GITLAB_MACHINE_TEMPLATE, or with the image keyword when the driver has
+// templates to pick from. Empty means the template of the driver config.
+func RequestedTemplate(hasTemplates bool) string {
+	if alias := os.Getenv(TemplateVariable); alias != "" {
+		return alias
+	}
+	if hasTemplates {
+		return os.Getenv(ImageVariable)
 	}
+	return ""
 }
 
-func WaitForSSH(d Driver) error {
-	// Try to dial SSH for 30 seconds before timing out.
-	if err := waitForSpecific(sshAvailableFunc(d), 1200, 10*time.Second); err != nil {
-		log.Error().Err(err).Msg("Error waiting for SSH")
-		return ErrTooManyRetriesForSSH
+// Communicators the drivers can reach their machines with
+const (
+	CommunicatorSSH   = "ssh"
+	CommunicatorWinRM = "winrm"
+)
+
+// CommunicatorCache keeps the communicator of a driver, so every command of
+// a stage reuses its connection. The zero value is empty.
+type CommunicatorCache struct {
+	comm communicator.Communicator
+}
+
+// Get returns the cached communicator, or the one returned by open
+func (c *CommunicatorCache) Get(open func() (communicator.Communicator, error)) (communicator.Communicator, error) {
+	if c.comm != nil {
+		return c.comm, nil
 	}
-	return nil
+	comm, err := open()
+	if err != nil {
+		return nil, err
+	}
+	c.comm = comm
+	return comm, nil
 }
 
-func waitForSpecific(f func() bool, maxAttempts int, waitInterval time.Duration) error {
-	return waitForSpecificOrError(func() (bool, error) {
-		return f(), nil
-	}, maxAttempts, waitInterval)
+// Close closes the cached communicator, if there is one. The next Get
+// opens a new one.
+func (c *CommunicatorCache) Close() error {
+	if c.comm == nil {
+		return nil
+	}
+	err := c.comm.Close()
+	c.comm = nil
+	return err
 }
 
-func waitForSpecificOrError(f func() (bool, error), maxAttempts int, waitInterval time.Duration) error {
-	for i := 0; i < maxAttempts; i++ {
-		stop, err := f()
-		if err != nil {
-			return err
-		}
-		if stop {
-			return nil
+// ValidateCommunicator checks the communicator name of a driver config
+// against its guest OS. Empty means SSH, and WinRM only works with Windows
+// guests.
+func ValidateCommunicator(name string, guestOS OStype) error {
+	switch name {
+	case "", CommunicatorSSH:
+		return nil
+	case CommunicatorWinRM:
+		if guestOS != Windows {
+			return fmt.Errorf("the winrm communicator needs windows guests, not %q", guestOS)
 		}
-		time.Sleep(waitInterval)
+		return nil
+	}
+	return fmt.Errorf("unknown communicator %q", name)
+}
+
+// SSHWait is the default wait for the communicator (SSH or not), overridden
+// by wait.ssh in the driver config
+var SSHWait = wait.Config{
+	Timeout:     30 * time.Minute,
+	Interval:    5 * time.Second,
+	MaxInterval: 30 * time.Second,
+	Successes:   1,
+}
+
+// WaitConfig returns the wait called name of the driver, if it is a Waiter,
+// with the unset fields taken from defaults
+func WaitConfig(d Driver, name string, defaults wait.Config) wait.Config {
+	if w, ok := d.(Waiter); ok {
+		return w.WaitConfig(name).WithDefaults(defaults)
 	}
-	return fmt.Errorf("maximum number of retries (%d) exceeded", maxAttempts)
+	return defaults
+}
+
+// WaitForCommunicator waits until we can run commands on the machine
+func WaitForCommunicator(ctx context.Context, d Driver) error {
+	cfg := WaitConfig(d, "ssh", SSHWait)
+	return wait.Until(ctx, "communicator", cfg, func(ctx context.Context) error {
+		_, err := runCommand(ctx, d, "exit")
+		return err
+	})
 }
 
-func runSSHCommandFromDriver(d Driver, command string) (string, error) {
-	client, err := d.GetSSHClientFromDriver()
+func runCommand(ctx context.Context, d Driver, command string) (string, error) {
+	c, err := d.GetCommunicator()
 	if err != nil {
 		return "", err
 	}
 
-	log.Debug().Msgf("Running SSH command: %s", command)
+	log.Debug().Msgf("Running command: %s", command)
 
-	output, err := client.Output(command)
+	output, err := communicator.Output(ctx, c, command)
 	if err != nil {
-		log.Error().
+		log.Debug().
 			Err(err).
 			Str("output", output).
-			Msgf("Error running SSH command")
-		return "", ErrExecutingSSHCommand
+			Msgf("Error running command")
+		return "", fmt.Errorf("%w: %v", ErrExecutingCommand, err)
 	}
 
 	return output, nil
@@ -0,0 +1,61 @@
+package libvirt
+
+import (
+	"github.com/spf13/viper"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/sizing"
+)
+
+func init() {
+	drivers.Register(DriverName, newFromConfig)
+}
+
+func newFromConfig(v *viper.Viper, machineName string) (drivers.Driver, error) {
+	cfg := LibvirtDriverConfig{
+		URI:            v.GetString("uri"),
+		DomainType:     v.GetString("domain_type"),
+		BaseImage:      v.GetString("base_image"),
+		ImagesDir:      v.GetString("images_dir"),
+		Network:        v.GetString("network"),
+		UserNetworking: v.GetBool("user_networking"),
+		NumCpus:        v.GetInt("num_cpus"),
+		MemoryMb:       v.GetInt("memory_mb"),
+		OS:             drivers.OStype(v.GetString("os")),
+		User:           v.GetString("user"),
+		Password:       v.GetString("password"),
+		SSHKey:         v.GetString("ssh_key"),
+		SSHHostCAs:     v.GetStringSlice("ssh_host_cas"),
+		Communicator:   v.GetString("communicator"),
+		BuildsDir:      v.GetString("builds_dir"),
+		CacheDir:       v.GetString("cache_dir"),
+	}
+
+	if err := v.UnmarshalKey("wait", &cfg.Waits); err != nil {
+		return nil, err
+	}
+	if err := v.UnmarshalKey("winrm", &cfg.WinRM); err != nil {
+		return nil, err
+	}
+	if err := drivers.ValidateCommunicator(cfg.Communicator, cfg.OS); err != nil {
+		return nil, err
+	}
+	if cfg.Communicator == drivers.CommunicatorWinRM {
+		if err := cfg.WinRM.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	sizes := sizing.Config{}
+	if err := v.UnmarshalKey("sizing", &sizes); err != nil {
+		return nil, err
+	}
+	size, err := sizes.Resolve(sizing.Size{Cpus: cfg.NumCpus, MemoryMb: cfg.MemoryMb}, "")
+	if err != nil {
+		return nil, err
+	}
+	cfg.NumCpus = size.Cpus
+	cfg.MemoryMb = size.MemoryMb
+
+	return NewLibvirtDriver(cfg, machineName)
+}
@@ -0,0 +1,77 @@
+package libvirt
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// domainXML is the definition of the job machine. With user-mode networking
+// there is no libvirt network, so QEMU forwards a local port to the guest SSH.
+var domainXML = template.Must(template.New("domain").Parse(`<domain type='{{ .DomainType }}'{{ if .UserNetworking }} xmlns:qemu='http://libvirt.org/schemas/domain/qemu/1.0'{{ end }}>
+  <name>{{ .Name }}</name>
+  <description>Created by gitlab-machine</description>
+  <memory unit='MiB'>{{ .MemoryMb }}</memory>
+  <vcpu>{{ .NumCpus }}</vcpu>
+  <os>
+    <type arch='x86_64'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+{{- if eq .DomainType "kvm" }}
+  <cpu mode='host-passthrough'/>
+{{- end }}
+  <on_poweroff>destroy</on_poweroff>
+  <on_reboot>restart</on_reboot>
+  <on_crash>destroy</on_crash>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='{{ .DiskPath }}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+{{- if not .UserNetworking }}
+    <interface type='network'>
+      <source network='{{ .Network }}'/>
+      <model type='virtio'/>
+    </interface>
+{{- end }}
+    <channel type='unix'>
+      <target type='virtio' name='org.qemu.guest_agent.0'/>
+    </channel>
+    <serial type='pty'/>
+    <console type='pty'/>
+  </devices>
+{{- if .UserNetworking }}
+  <qemu:commandline>
+    <qemu:arg value='-netdev'/>
+    <qemu:arg value='user,id=gitlabmachine0,hostfwd=tcp:127.0.0.1:{{ .HostPort }}-:{{ .GuestPort }}'/>
+    <qemu:arg value='-device'/>
+    <qemu:arg value='virtio-net-pci,netdev=gitlabmachine0'/>
+  </qemu:commandline>
+{{- end }}
+</domain>
+`))
+
+type domainParams struct {
+	Name           string
+	DomainType     string
+	MemoryMb       int
+	NumCpus        int
+	DiskPath       string
+	Network        string
+	UserNetworking bool
+	// with user networking, HostPort is forwarded to the communicator port
+	HostPort  int
+	GuestPort int
+}
+
+func renderDomainXML(p domainParams) (string, error) {
+	var buf bytes.Buffer
+	if err := domainXML.Execute(&buf, p); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
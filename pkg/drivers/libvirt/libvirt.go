@@ -0,0 +1,398 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/ssh"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+	"github.com/juanfont/gitlab-machine/pkg/winrm"
+)
+
+const (
+	DriverName = "libvirt"
+	SSHPort    = 22
+
+	defaultNumCpus  = 2
+	defaultMemoryMb = 2048
+
+	ErrNoIPAddress = utils.Error("could not get the IP address of the domain")
+)
+
+var ipWait = wait.Config{
+	Timeout:     5 * time.Minute,
+	Interval:    2 * time.Second,
+	MaxInterval: 10 * time.Second,
+}
+
+type LibvirtDriverConfig struct {
+	URI        string // qemu:///system, qemu:///session...
+	DomainType string // kvm, or qemu when there is no hardware acceleration
+	BaseImage  string // qcow2 backing image, never modified
+	ImagesDir  string // where the overlays of the jobs are created
+	Network    string // libvirt network, ignored with user-mode networking
+
+	// UserNetworking uses QEMU user-mode networking, forwarding a local port
+	// to the guest SSH. Works without root or a libvirt network.
+	UserNetworking bool
+
+	NumCpus  int
+	MemoryMb int
+	OS       drivers.OStype
+
+	User     string
+	Password string
+	SSHKey   string
+	// CAs whose host certificates are trusted. Without them, the host key
+	// seen when the machine is created is pinned.
+	SSHHostCAs []string
+
+	// Communicator is ssh (default) or winrm, for Windows guests without OpenSSH
+	Communicator string
+	WinRM        winrm.Config
+
+	BuildsDir string
+	CacheDir  string
+
+	// overrides the defaults of the waits (ip, ssh)
+	Waits wait.Configs
+}
+
+type LibvirtDriver struct {
+	cfg         LibvirtDriverConfig
+	machineName string
+	ip          string
+	port        int // where the communicator is reached, forwarded with user networking
+	hostKey     string
+	comm        drivers.CommunicatorCache
+	createdAt   time.Time
+}
+
+func NewLibvirtDriver(cfg LibvirtDriverConfig, machineName string) (*LibvirtDriver, error) {
+	if cfg.BaseImage == "" {
+		return nil, fmt.Errorf("a base image is required")
+	}
+	if cfg.URI == "" {
+		cfg.URI = "qemu:///system"
+	}
+	if cfg.DomainType == "" {
+		cfg.DomainType = "kvm"
+	}
+	if cfg.ImagesDir == "" {
+		cfg.ImagesDir = filepath.Dir(cfg.BaseImage)
+	}
+	if cfg.Network == "" {
+		cfg.Network = "default"
+	}
+	if cfg.OS == "" {
+		cfg.OS = drivers.Linux
+	}
+	if cfg.NumCpus <= 0 {
+		cfg.NumCpus = defaultNumCpus
+	}
+	if cfg.MemoryMb <= 0 {
+		cfg.MemoryMb = defaultMemoryMb
+	}
+	if cfg.User == "" {
+		if cfg.OS == drivers.Windows {
+			cfg.User = "Administrator"
+		} else {
+			cfg.User = "root"
+		}
+	}
+
+	d := LibvirtDriver{
+		cfg:         cfg,
+		machineName: machineName,
+	}
+	return &d, nil
+}
+
+func (d *LibvirtDriver) GetDriverName() string {
+	return DriverName
+}
+
+func (d *LibvirtDriver) GetMachineName() string {
+	return d.machineName
+}
+
+func (d *LibvirtDriver) WaitConfig(name string) wait.Config {
+	return d.cfg.Waits[name]
+}
+
+func (d *LibvirtDriver) GetOS() (drivers.OStype, error) {
+	return d.cfg.OS, nil
+}
+
+func (d *LibvirtDriver) GetBuildsDir() string {
+	if d.cfg.BuildsDir != "" {
+		return d.cfg.BuildsDir
+	}
+	return drivers.DefaultBuildsDir(d.cfg.OS)
+}
+
+func (d *LibvirtDriver) GetCacheDir() string {
+	if d.cfg.CacheDir != "" {
+		return d.cfg.CacheDir
+	}
+	return drivers.DefaultCacheDir(d.cfg.OS)
+}
+
+func (d *LibvirtDriver) SaveState(st *state.JobState) {
+	st.IP = d.ip
+	st.SSHPort = d.port
+	st.OS = string(d.cfg.OS)
+	st.AdminPassword = d.cfg.Password
+	st.SSHHostKey = d.hostKey
+	st.CreatedAt = d.createdAt
+}
+
+func (d *LibvirtDriver) RestoreState(st *state.JobState) {
+	d.ip = st.IP
+	d.port = st.SSHPort
+	if st.AdminPassword != "" {
+		d.cfg.Password = st.AdminPassword
+	}
+	d.hostKey = st.SSHHostKey
+	d.createdAt = st.CreatedAt
+}
+
+func (d *LibvirtDriver) Create() error {
+	log.Info().Msgf("Creating a new domain %s", d.machineName)
+	d.createdAt = time.Now()
+
+	// the overlay only stores what the job writes, the base image is shared
+	disk := d.diskPath()
+	out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", d.cfg.BaseImage, disk).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error creating overlay %s: %s: %w", disk, strings.TrimSpace(string(out)), err)
+	}
+
+	d.port = d.guestPort()
+	if d.cfg.UserNetworking {
+		d.port, err = freeLocalPort()
+		if err != nil {
+			return err
+		}
+		d.ip = "127.0.0.1"
+	}
+
+	xml, err := renderDomainXML(domainParams{
+		Name:           d.machineName,
+		DomainType:     d.cfg.DomainType,
+		MemoryMb:       d.cfg.MemoryMb,
+		NumCpus:        d.cfg.NumCpus,
+		DiskPath:       disk,
+		Network:        d.cfg.Network,
+		UserNetworking: d.cfg.UserNetworking,
+		HostPort:       d.port,
+		GuestPort:      d.guestPort(),
+	})
+	if err != nil {
+		return err
+	}
+
+	xmlFile, err := os.CreateTemp("", "gitlab-machine-*.xml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(xmlFile.Name())
+	if _, err := xmlFile.WriteString(xml); err != nil {
+		xmlFile.Close()
+		return err
+	}
+	xmlFile.Close()
+
+	if _, err := d.virsh("define", xmlFile.Name()); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Booting up %s", d.machineName)
+	if _, err := d.virsh("start", d.machineName); err != nil {
+		return err
+	}
+
+	log.Info().Msg("Waiting for the machine to get an IP address")
+	if _, err := d.GetIP(); err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Waiting for %s to be available", d.communicator())
+	err = drivers.WaitForCommunicator(context.Background(), d)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("%s is available", d.communicator())
+	return nil
+}
+
+func (d *LibvirtDriver) GetCommunicator() (communicator.Communicator, error) {
+	return d.comm.Get(d.openCommunicator)
+}
+
+func (d *LibvirtDriver) openCommunicator() (communicator.Communicator, error) {
+	auth := ssh.Auth{
+		HostKey:   d.hostKey,
+		OnHostKey: func(hostKey string) { d.hostKey = hostKey },
+		HostCAs:   d.cfg.SSHHostCAs,
+	}
+	if d.cfg.SSHKey != "" {
+		auth.Keys = []string{d.cfg.SSHKey}
+	}
+	if d.cfg.Password != "" {
+		auth.Passwords = []string{d.cfg.Password}
+	}
+
+	ip, err := d.GetIP()
+	if err != nil {
+		return nil, err
+	}
+
+	port := d.port
+	if port == 0 {
+		port = d.guestPort()
+	}
+
+	if d.cfg.Communicator == drivers.CommunicatorWinRM {
+		client, err := winrm.NewClient(d.cfg.User, d.cfg.Password, ip, port, d.cfg.WinRM)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	client, err := ssh.NewClient(d.cfg.User, ip, port, &auth)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes the connection to the machine, if there is one
+func (d *LibvirtDriver) Close() error {
+	return d.comm.Close()
+}
+
+func (d *LibvirtDriver) Destroy() error {
+	_ = d.Close()
+
+	log.Info().Msgf("Destroying domain %s", d.machineName)
+
+	// fails when the domain is not running, which is fine
+	if _, err := d.virsh("destroy", d.machineName); err != nil {
+		log.Warn().Err(err).Msg("Error stopping domain")
+	}
+
+	// the overlay is removed even when the domain cannot be undefined, it
+	// is useless without it
+	var errs []string
+	if _, err := d.virsh("undefine", d.machineName); err != nil {
+		errs = append(errs, fmt.Sprintf("error undefining domain: %s", err))
+	}
+	if err := os.Remove(d.diskPath()); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, fmt.Sprintf("error removing disk: %s", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// GetIP returns the address of the domain, asking the DHCP server of the
+// libvirt network first and then the guest agent
+func (d *LibvirtDriver) GetIP() (string, error) {
+	if d.ip != "" {
+		return d.ip, nil
+	}
+
+	err := wait.Until(context.Background(), "IP address", drivers.WaitConfig(d, "ip", ipWait), func(ctx context.Context) error {
+		for _, source := range []string{"lease", "agent"} {
+			out, err := d.virsh("domifaddr", d.machineName, "--source", source)
+			if err != nil {
+				log.Debug().Err(err).Str("source", source).Msg("Error getting domain addresses")
+				continue
+			}
+			if ip := parseDomIfAddr(out); ip != "" {
+				d.ip = ip
+				return nil
+			}
+		}
+		return ErrNoIPAddress
+	})
+	if err != nil {
+		return "", err
+	}
+	return d.ip, nil
+}
+
+func (d *LibvirtDriver) communicator() string {
+	if d.cfg.Communicator == drivers.CommunicatorWinRM {
+		return "WinRM"
+	}
+	return "SSH"
+}
+
+// guestPort returns the port the communicator listens on in the guest
+func (d *LibvirtDriver) guestPort() int {
+	if d.cfg.Communicator == drivers.CommunicatorWinRM {
+		return d.cfg.WinRM.GuestPort()
+	}
+	return SSHPort
+}
+
+func (d *LibvirtDriver) diskPath() string {
+	return filepath.Join(d.cfg.ImagesDir, fmt.Sprintf("%s.qcow2", d.machineName))
+}
+
+func (d *LibvirtDriver) virsh(args ...string) (string, error) {
+	args = append([]string{"--connect", d.cfg.URI}, args...)
+	log.Debug().Strs("args", args).Msg("Running virsh")
+
+	out, err := exec.Command("virsh", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("virsh %s: %s: %w", args[2], strings.TrimSpace(string(out)), err)
+	}
+	return string(out), nil
+}
+
+// parseDomIfAddr returns the first non-loopback IPv4 address in the output
+// of virsh domifaddr
+//
+//	Name       MAC address          Protocol     Address
+//	-------------------------------------------------------------------------------
+//	vnet0      52:54:00:8c:3e:5a    ipv4         192.168.122.45/24
+func parseDomIfAddr(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "ipv4" {
+			continue
+		}
+		ip := strings.Split(fields[3], "/")[0]
+		if !strings.HasPrefix(ip, "127.") {
+			return ip
+		}
+	}
+	return ""
+}
+
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
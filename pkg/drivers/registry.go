@@ -0,0 +1,56 @@
+package drivers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Factory creates a driver from its config sub-tree (drivers.<name> in the config file)
+type Factory func(cfg *viper.Viper, machineName string) (Driver, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a driver available by name. Drivers call it from their init function.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("driver %s registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// New creates the driver registered with that name
+func New(name string, cfg *viper.Viper, machineName string) (Driver, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown driver %q (available: %v)", name, Names())
+	}
+	if cfg == nil {
+		cfg = viper.New()
+	}
+	return factory(cfg, machineName)
+}
+
+// Names returns the registered drivers, sorted
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
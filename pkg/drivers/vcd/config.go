@@ -0,0 +1,107 @@
+package vcd
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/sizing"
+)
+
+func init() {
+	drivers.Register(DriverName, newFromConfig)
+}
+
+func newFromConfig(v *viper.Viper, machineName string) (drivers.Driver, error) {
+	cfg := VcdDriverConfig{
+		VcdURL:           v.GetString("url"),
+		VcdOrg:           v.GetString("org"),
+		VcdVdc:           v.GetString("vdc"),
+		VcdInsecure:      v.GetBool("insecure"),
+		VcdUser:          v.GetString("user"),
+		VcdPassword:      v.GetString("password"),
+		VcdOrgVDCNetwork: v.GetString("vdc_network"),
+		Catalog:          v.GetString("catalog"),
+		Template:         v.GetString("template"),
+		NumCpus:          v.GetInt("num_cpus"),
+		CoresPerSocket:   v.GetInt("cores_per_socket"),
+		MemorySizeMb:     v.GetInt("memory_mb"),
+		Description:      "Created by gitlab-machine",
+		StorageProfile:   v.GetString("storage_profile"),
+		OS:               drivers.OStype(v.GetString("os")),
+		BuildsDir:        v.GetString("builds_dir"),
+		CacheDir:         v.GetString("cache_dir"),
+
+		DefaultPassword: v.GetString("default_password"),
+		RandomPassword:  v.GetBool("random_password"),
+		SSHHostCAs:      v.GetStringSlice("ssh_host_cas"),
+		Communicator:    v.GetString("communicator"),
+	}
+
+	if err := v.UnmarshalKey("wait", &cfg.Waits); err != nil {
+		return nil, err
+	}
+	if err := v.UnmarshalKey("winrm", &cfg.WinRM); err != nil {
+		return nil, err
+	}
+	if err := v.UnmarshalKey("readiness", &cfg.Readiness); err != nil {
+		return nil, err
+	}
+	if err := cfg.Readiness.validate(); err != nil {
+		return nil, err
+	}
+
+	templates := map[string]Template{}
+	if err := v.UnmarshalKey("templates", &templates); err != nil {
+		return nil, err
+	}
+	if err := validateCommunicator(cfg, templates); err != nil {
+		return nil, err
+	}
+	defaultClass, err := applyTemplate(&cfg, templates)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := sizing.Config{}
+	if err := v.UnmarshalKey("sizing", &sizes); err != nil {
+		return nil, err
+	}
+	size, err := sizes.Resolve(sizing.Size{
+		Cpus:           cfg.NumCpus,
+		CoresPerSocket: cfg.CoresPerSocket,
+		MemoryMb:       cfg.MemorySizeMb,
+	}, defaultClass)
+	if err != nil {
+		return nil, err
+	}
+	cfg.NumCpus = size.Cpus
+	cfg.CoresPerSocket = size.CoresPerSocket
+	cfg.MemorySizeMb = size.MemoryMb
+
+	return NewVcdDriver(cfg, machineName)
+}
+
+// validateCommunicator checks the communicator against the OS of the config
+// and of every template setting its own, so a bad pairing fails every job
+// and not only the ones picking that template. winrm also needs https, or
+// plain http explicitly allowed.
+func validateCommunicator(cfg VcdDriverConfig, templates map[string]Template) error {
+	if err := drivers.ValidateCommunicator(cfg.Communicator, effectiveOS(cfg.OS)); err != nil {
+		return err
+	}
+	for _, alias := range templateAliases(templates) {
+		t := templates[alias]
+		if t.OS == "" {
+			continue
+		}
+		if err := drivers.ValidateCommunicator(cfg.Communicator, drivers.OStype(t.OS)); err != nil {
+			return fmt.Errorf("template %q: %w", alias, err)
+		}
+	}
+	if cfg.Communicator == drivers.CommunicatorWinRM {
+		return cfg.WinRM.Validate()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package vcd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+const (
+	passwordLength   = 24
+	passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// customizationScript returns the guest customization script that authorizes
+// the SSH key of the job. vCD runs it with precustomization and then
+// postcustomization as first argument.
+func customizationScript(machineOS drivers.OStype, authorizedKey string) string {
+	if machineOS == drivers.Windows {
+		// Windows OpenSSH only reads this file for the administrators, and
+		// ignores it unless only they and SYSTEM can access it
+		return strings.Join([]string{
+			`@echo off`,
+			`if "%1%" == "postcustomization" (`,
+			`  if not exist C:\ProgramData\ssh mkdir C:\ProgramData\ssh`,
+			fmt.Sprintf(`  echo %s>>C:\ProgramData\ssh\administrators_authorized_keys`, authorizedKey),
+			`  icacls C:\ProgramData\ssh\administrators_authorized_keys /inheritance:r /grant "Administrators:F" /grant "SYSTEM:F"`,
+			`)`,
+		}, "\r\n")
+	}
+
+	return strings.Join([]string{
+		`#!/bin/sh`,
+		`if [ "$1" = "postcustomization" ]; then`,
+		`  mkdir -p /root/.ssh && chmod 700 /root/.ssh`,
+		fmt.Sprintf(`  echo '%s' >> /root/.ssh/authorized_keys`, authorizedKey),
+		`  chmod 600 /root/.ssh/authorized_keys`,
+		`fi`,
+	}, "\n")
+}
+
+// randomPassword returns a password meeting the default Windows complexity
+// requirements
+func randomPassword() (string, error) {
+	max := big.NewInt(int64(len(passwordAlphabet)))
+	for {
+		b := make([]byte, passwordLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			b[i] = passwordAlphabet[n.Int64()]
+		}
+
+		p := string(b)
+		if strings.ContainsAny(p, "abcdefghijkmnopqrstuvwxyz") &&
+			strings.ContainsAny(p, "ABCDEFGHJKLMNPQRSTUVWXYZ") &&
+			strings.ContainsAny(p, "23456789") {
+			return p, nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package vcd
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+// ListMachines returns the vApps of the VDC created by gitlab-machine, i.e.
+// with our description or metadata. Names are not checked, as they come from
+// a configurable template.
+func (d *VcdDriver) ListMachines() ([]drivers.Machine, error) {
+	org, err := d.client.GetOrgByName(d.cfg.VcdOrg)
+	if err != nil {
+		return nil, err
+	}
+	vdc, err := org.GetVDCByName(d.cfg.VcdVdc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := []drivers.Machine{}
+	for _, ref := range vdc.GetVappList() {
+		vapp, err := vdc.GetVAppByHref(ref.HREF)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Error getting vApp %s", ref.Name)
+			continue
+		}
+		metadata, err := vAppMetadata(vapp)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Error getting metadata of vApp %s", ref.Name)
+			continue
+		}
+		if vapp.VApp.Description != d.cfg.Description && len(metadata) == 0 {
+			continue
+		}
+
+		m, err := machineFromVApp(vapp, metadata)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Error parsing creation date of vApp %s", ref.Name)
+			continue
+		}
+		machines = append(machines, m)
+	}
+
+	return machines, nil
+}
+
+// DestroyMachine destroys the vApp by the HREF it was listed with, as
+// names are not unique
+func (d *VcdDriver) DestroyMachine(m drivers.Machine) error {
+	vapp := govcd.NewVApp(&d.client.Client)
+	vapp.VApp.HREF = m.ID
+	if err := vapp.Refresh(); err != nil {
+		return err
+	}
+
+	return destroyVApp(vapp)
+}
+
+// machineFromVApp prefers the job metadata of the vApp, falling back to what
+// we can tell from its name for the vApps created before we tagged them
+func machineFromVApp(vapp *govcd.VApp, metadata map[string]string) (drivers.Machine, error) {
+	projectID, jobID := drivers.ParseMachineName(vapp.VApp.Name)
+	if id, ok := metadata[drivers.MetadataProjectID]; ok {
+		projectID = id
+	}
+	if id, ok := metadata[drivers.MetadataJobID]; ok {
+		jobID = id
+	}
+
+	created := vapp.VApp.DateCreated
+	if c, ok := metadata[drivers.MetadataCreatedAt]; ok {
+		created = c
+	}
+	createdAt, err := time.Parse(time.RFC3339, created)
+	if err != nil {
+		return drivers.Machine{}, err
+	}
+
+	return drivers.Machine{
+		ID:        vapp.VApp.HREF,
+		Name:      vapp.VApp.Name,
+		CreatedAt: createdAt,
+		ProjectID: projectID,
+		JobID:     jobID,
+	}, nil
+}
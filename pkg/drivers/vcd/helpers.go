@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/vmware/go-vcloud-director/v2/govcd"
 )
 
@@ -21,6 +22,14 @@ func (d *VcdDriver) getVApp() (*govcd.VApp, error) {
 		return vapp, nil
 	}
 
+	// names can be shared by several vApps, the job ID cannot
+	vapp, err := d.findJobVApp()
+	if err == nil {
+		d.VAppHREF = vapp.VApp.HREF
+		return vapp, nil
+	}
+	log.Debug().Err(err).Msg("Could not find the vApp by its metadata, looking it up by name")
+
 	org, err := d.client.GetOrgByName(d.cfg.VcdOrg)
 	if err != nil {
 		return nil, err
@@ -29,7 +38,7 @@ func (d *VcdDriver) getVApp() (*govcd.VApp, error) {
 	if err != nil {
 		return nil, err
 	}
-	vapp, err := vdc.GetVAppByName(d.machineName, true)
+	vapp, err = vdc.GetVAppByName(d.machineName, true)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,106 @@
+package vcd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+func (d *VcdDriver) SetMetadata(metadata map[string]string) {
+	d.metadata = metadata
+}
+
+// tagVApp attaches the job metadata to the vApp, so operators can find the
+// machine of a job in the vCD UI
+func (d *VcdDriver) tagVApp(vapp *govcd.VApp) error {
+	for key, value := range d.metadata {
+		log.Debug().Str("key", key).Str("value", value).Msg("Adding vApp metadata")
+		if err := vapp.AddMetadataEntry(types.MetadataStringValue, key, value); err != nil {
+			return fmt.Errorf("error adding metadata %s to vApp %s: %w", key, vapp.VApp.Name, err)
+		}
+	}
+	return nil
+}
+
+// vAppMetadata returns the gitlab-machine metadata entries of the vApp
+func vAppMetadata(vapp *govcd.VApp) (map[string]string, error) {
+	metadata, err := vapp.GetMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	for _, e := range metadata.MetadataEntry {
+		if e == nil || e.TypedValue == nil || !strings.HasPrefix(e.Key, "gitlab-machine.") {
+			continue
+		}
+		entries[e.Key] = e.TypedValue.Value
+	}
+	return entries, nil
+}
+
+// findVAppsByMetadata returns our vApps with the given metadata entry. The
+// filtering is done by vCD, with a single query for the whole VDC.
+func (d *VcdDriver) findVAppsByMetadata(key string, value string) ([]*govcd.VApp, error) {
+	org, err := d.client.GetOrgByName(d.cfg.VcdOrg)
+	if err != nil {
+		return nil, err
+	}
+	vdc, err := org.GetVDCByName(d.cfg.VcdVdc, false)
+	if err != nil {
+		return nil, err
+	}
+
+	queryType := types.QtVapp
+	if d.client.Client.IsSysAdmin {
+		queryType = types.QtAdminVapp
+	}
+	results, err := vdc.QueryWithNotEncodedParams(nil, map[string]string{
+		"type": queryType,
+		"filter": fmt.Sprintf("metadata:%s==STRING:%s;vdc==%s",
+			key, url.QueryEscape(value), url.QueryEscape(vdc.Vdc.HREF)),
+		"filterEncoded": "true",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	records := results.Results.VAppRecord
+	if d.client.Client.IsSysAdmin {
+		records = results.Results.AdminVAppRecord
+	}
+
+	vapps := []*govcd.VApp{}
+	for _, r := range records {
+		vapp, err := vdc.GetVAppByHref(r.HREF)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Error getting vApp %s", r.Name)
+			continue
+		}
+		vapps = append(vapps, vapp)
+	}
+	return vapps, nil
+}
+
+// findJobVApp looks up the vApp of the current job by its metadata
+func (d *VcdDriver) findJobVApp() (*govcd.VApp, error) {
+	jobID := d.metadata[drivers.MetadataJobID]
+	if jobID == "" {
+		return nil, govcd.ErrorEntityNotFound
+	}
+
+	vapps, err := d.findVAppsByMetadata(drivers.MetadataJobID, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if len(vapps) != 1 {
+		return nil, fmt.Errorf("found %d vApps for job %s", len(vapps), jobID)
+	}
+	return vapps[0], nil
+}
@@ -0,0 +1,124 @@
+package vcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/probe"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
+
+// probeTools passes once the VMware Tools of the guest are running
+const probeTools = "tools"
+
+// RDP must answer for a while in a row, as the VMware Tools reboot the
+// Windows VMs several times during the customization
+var rdpWait = wait.Config{
+	Timeout:     20 * time.Minute,
+	Interval:    5 * time.Second,
+	MaxInterval: 15 * time.Second,
+	Successes:   40,
+}
+
+// Readiness are the probes run after booting the machine, by guest OS
+type Readiness struct {
+	Windows []probe.Config `mapstructure:"windows"`
+	Linux   []probe.Config `mapstructure:"linux"`
+}
+
+// validate checks the probes can run, so a typo fails in the config stage
+func (r Readiness) validate() error {
+	if err := probe.Validate(r.Windows, probeTools); err != nil {
+		return err
+	}
+	return probe.Validate(r.Linux, probeTools)
+}
+
+// readinessProbes returns the probes of the template picked by the job,
+// then the ones of the OS. Linux guests do not reboot during customization,
+// nor listen on RDP, so by default they only wait for SSH. Windows guests
+// wait for RDP, then for the communicator.
+func (d *VcdDriver) readinessProbes(machineOS drivers.OStype) []probe.Config {
+	if len(d.cfg.TemplateReadiness) > 0 {
+		return d.cfg.TemplateReadiness
+	}
+	if machineOS == drivers.Windows {
+		if len(d.cfg.Readiness.Windows) > 0 {
+			return d.cfg.Readiness.Windows
+		}
+		rdp := probe.Config{Type: probe.TypeTCP, Port: 3389, Wait: drivers.WaitConfig(d, "rdp", rdpWait)}
+		if d.cfg.Communicator == drivers.CommunicatorWinRM {
+			return []probe.Config{rdp, {Type: probe.TypeWinRM, Port: d.cfg.WinRM.GuestPort(), TLS: d.cfg.WinRM.HTTPS}}
+		}
+		return []probe.Config{rdp, {Type: probe.TypeSSH}}
+	}
+	if len(d.cfg.Readiness.Linux) > 0 {
+		return d.cfg.Readiness.Linux
+	}
+	return []probe.Config{{Type: probe.TypeSSH}}
+}
+
+// waitUntilReady runs the readiness probes of the machine
+func (d *VcdDriver) waitUntilReady(ip string, machineOS drivers.OStype) error {
+	// ssh probes keep honouring wait.ssh
+	probes := append([]probe.Config(nil), d.readinessProbes(machineOS)...)
+	sshWait := drivers.WaitConfig(d, "ssh", drivers.SSHWait)
+	for i := range probes {
+		if probes[i].Type == probe.TypeSSH {
+			probes[i].Wait = probes[i].Wait.WithDefaults(sshWait)
+		}
+	}
+
+	return probe.Wait(context.Background(), probes, probe.Target{
+		Host: ip,
+		SSH: func(ctx context.Context, command string) error {
+			c, err := d.GetCommunicator()
+			if err != nil {
+				return err
+			}
+			_, err = communicator.Output(ctx, c, command)
+			return err
+		},
+		Custom: map[string]wait.Condition{
+			probeTools: d.toolsRunning,
+		},
+	})
+}
+
+// toolsRunning asks vCD about the status of the VMware Tools of the VM
+func (d *VcdDriver) toolsRunning(ctx context.Context) error {
+	vapp, err := d.getVApp()
+	if err != nil {
+		return err
+	}
+	vm, err := d.getVM()
+	if err != nil {
+		return err
+	}
+
+	org, err := d.client.GetOrgByName(d.cfg.VcdOrg)
+	if err != nil {
+		return err
+	}
+	vdc, err := org.GetVDCByName(d.cfg.VcdVdc, false)
+	if err != nil {
+		return err
+	}
+
+	record, err := vdc.QueryVM(vapp.VApp.Name, vm.VM.Name)
+	if err != nil {
+		return err
+	}
+
+	// toolsOld still runs, only toolsNotInstalled and toolsNotRunning fail
+	status := record.VM.VmToolsStatus
+	switch strings.ToLower(status) {
+	case "toolsok", "toolsold":
+		return nil
+	}
+	return fmt.Errorf("the VMware Tools are not running yet (status %q)", status)
+}
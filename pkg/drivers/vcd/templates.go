@@ -0,0 +1,61 @@
+package vcd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/probe"
+)
+
+// Template is a vApp template jobs can pick by its alias
+type Template struct {
+	Catalog  string `mapstructure:"catalog"`
+	Template string `mapstructure:"template"`
+	OS       string `mapstructure:"os"`
+	// sizing class used when the job does not ask for one
+	Size string `mapstructure:"size"`
+	// name of the provisioning profile, the default provisioning when empty
+	ProvisionProfile string `mapstructure:"provision_profile"`
+	// probes run after booting, instead of the ones of the OS
+	Readiness []probe.Config `mapstructure:"readiness"`
+}
+
+// applyTemplate replaces the template of the config with the one the job
+// asked for, rejecting aliases not in the config. It returns the default
+// sizing class of the template.
+func applyTemplate(cfg *VcdDriverConfig, templates map[string]Template) (string, error) {
+	alias := drivers.RequestedTemplate(len(templates) > 0)
+	if alias == "" {
+		return "", nil
+	}
+
+	// viper lowercases the keys of the config
+	t, ok := templates[strings.ToLower(alias)]
+	if !ok {
+		return "", fmt.Errorf("template %q is not allowed (allowed: %v)", alias, templateAliases(templates))
+	}
+
+	cfg.TemplateAlias = alias
+	cfg.Catalog = t.Catalog
+	cfg.Template = t.Template
+	if t.OS != "" {
+		cfg.OS = drivers.OStype(t.OS)
+	}
+	cfg.ProvisionProfile = t.ProvisionProfile
+	if err := probe.Validate(t.Readiness, probeTools); err != nil {
+		return "", fmt.Errorf("template %q: %w", alias, err)
+	}
+	cfg.TemplateReadiness = t.Readiness
+	return t.Size, nil
+}
+
+func templateAliases(templates map[string]Template) []string {
+	aliases := make([]string, 0, len(templates))
+	for alias := range templates {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	return aliases
+}
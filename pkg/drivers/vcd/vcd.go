@@ -1,6 +1,7 @@
 package vcd
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -8,13 +9,28 @@ import (
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
 	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/probe"
 	"github.com/juanfont/gitlab-machine/pkg/ssh"
+	"github.com/juanfont/gitlab-machine/pkg/state"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+	"github.com/juanfont/gitlab-machine/pkg/winrm"
 	"github.com/vmware/go-vcloud-director/v2/govcd"
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
 )
 
-const SSHPort = 22
+const (
+	SSHPort    = 22
+	DriverName = "vcd"
+)
+
+// the VM powers off once vCD has deployed it, before we customize it
+var deployWait = wait.Config{
+	Timeout:     15 * time.Minute,
+	Interval:    5 * time.Second,
+	MaxInterval: 15 * time.Second,
+}
 
 type VcdDriverConfig struct {
 	VcdURL           string
@@ -26,6 +42,10 @@ type VcdDriverConfig struct {
 	VcdOrgVDCNetwork string
 	Catalog          string
 	Template         string
+	// alias of the template picked by the job, empty for the one above
+	TemplateAlias string
+	// provisioning profile of the picked template, empty for the default one
+	ProvisionProfile string
 
 	NumCpus        int
 	CoresPerSocket int
@@ -35,16 +55,49 @@ type VcdDriverConfig struct {
 	Description    string
 	StorageProfile string
 
+	// OS of the template. The machine does not exist yet during the
+	// config stage, so we cannot ask vCD about it
+	OS        drivers.OStype
+	BuildsDir string
+	CacheDir  string
+
+	// DefaultPassword is the admin password of the machines, unless
+	// RandomPassword is set. Empty means a random password too.
 	DefaultPassword string
+	RandomPassword  bool
+
+	// overrides the defaults of the waits (deploy, rdp, ssh)
+	Waits wait.Configs
+
+	// CAs whose host certificates are trusted. Without them, the host key
+	// seen when the machine is created is pinned.
+	SSHHostCAs []string
+
+	// Communicator is ssh (default) or winrm, for Windows guests without OpenSSH
+	Communicator string
+	WinRM        winrm.Config
+
+	// probes run after booting the machine, by guest OS. The ones of the
+	// picked template replace them.
+	Readiness         Readiness
+	TemplateReadiness []probe.Config
 }
 
 type VcdDriver struct {
 	cfg           VcdDriverConfig
 	client        *govcd.VCDClient
 	machineName   string
+	hostname      string
 	VAppHREF      string
 	VMHREF        string
 	adminPassword string
+	sshKey        []byte
+	hostKey       string
+	comm          drivers.CommunicatorCache
+	ip            string
+	os            drivers.OStype
+	createdAt     time.Time
+	metadata      map[string]string
 }
 
 func NewVcdDriver(cfg VcdDriverConfig, machineName string) (*VcdDriver, error) {
@@ -61,18 +114,129 @@ func NewVcdDriver(cfg VcdDriverConfig, machineName string) (*VcdDriver, error) {
 		cfg:           cfg,
 		client:        c,
 		machineName:   machineName,
+		VAppHREF:      cfg.VAppHREF,
+		VMHREF:        cfg.VMHREF,
 		adminPassword: cfg.DefaultPassword,
 	}
 
 	return &d, nil
 }
 
+func (d *VcdDriver) GetDriverName() string {
+	return DriverName
+}
+
 func (d *VcdDriver) GetMachineName() string {
 	return d.machineName
 }
 
+func (d *VcdDriver) GetBuildsDir() string {
+	if d.cfg.BuildsDir != "" {
+		return d.cfg.BuildsDir
+	}
+	return drivers.DefaultBuildsDir(d.templateOS())
+}
+
+func (d *VcdDriver) GetCacheDir() string {
+	if d.cfg.CacheDir != "" {
+		return d.cfg.CacheDir
+	}
+	return drivers.DefaultCacheDir(d.templateOS())
+}
+
+func (d *VcdDriver) WaitConfig(name string) wait.Config {
+	return d.cfg.Waits[name]
+}
+
+func (d *VcdDriver) GuestOS() drivers.OStype {
+	return d.templateOS()
+}
+
+func (d *VcdDriver) SetHostname(hostname string) {
+	d.hostname = hostname
+}
+
+func (d *VcdDriver) ProvisionProfile() string {
+	return d.cfg.ProvisionProfile
+}
+
+// templateOS returns the configured OS of the template, defaulting to Windows
+func (d *VcdDriver) templateOS() drivers.OStype {
+	return effectiveOS(d.cfg.OS)
+}
+
+// effectiveOS returns the OS a template is assumed to run when its config
+// leaves it empty
+func effectiveOS(os drivers.OStype) drivers.OStype {
+	if os == "" {
+		return drivers.Windows
+	}
+	return os
+}
+
+func (d *VcdDriver) SaveState(st *state.JobState) {
+	st.VAppHREF = d.VAppHREF
+	st.VMHREF = d.VMHREF
+	st.IP = d.ip
+	st.OS = string(d.os)
+	st.AdminPassword = d.adminPassword
+	st.SSHPrivateKey = string(d.sshKey)
+	st.SSHHostKey = d.hostKey
+	st.CreatedAt = d.createdAt
+}
+
+func (d *VcdDriver) RestoreState(st *state.JobState) {
+	d.VAppHREF = st.VAppHREF
+	d.VMHREF = st.VMHREF
+	d.ip = st.IP
+	d.os = drivers.OStype(st.OS)
+	if st.AdminPassword != "" {
+		d.adminPassword = st.AdminPassword
+	}
+	if st.SSHPrivateKey != "" {
+		d.sshKey = []byte(st.SSHPrivateKey)
+	}
+	d.hostKey = st.SSHHostKey
+	d.createdAt = st.CreatedAt
+}
+
+func (d *VcdDriver) Adopt(st *state.JobState) error {
+	d.RestoreState(st)
+
+	vapp, err := d.getVApp()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Msgf("Renaming %s to %s", vapp.VApp.Name, d.machineName)
+	if err := vapp.Rename(d.machineName); err != nil {
+		return err
+	}
+
+	if err := d.tagVApp(vapp); err != nil {
+		log.Warn().Err(err).Msg("Error tagging vApp")
+	}
+	return nil
+}
+
 func (d *VcdDriver) Create() error {
 	log.Info().Msgf("Creating a new machine %s", d.machineName)
+	d.createdAt = time.Now()
+
+	// every machine gets its own key, so a leaked key only opens one machine
+	privateKey, authorizedKey, err := ssh.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	d.sshKey = privateKey
+
+	if d.cfg.RandomPassword || d.cfg.DefaultPassword == "" {
+		d.adminPassword, err = randomPassword()
+		if err != nil {
+			return err
+		}
+	}
+
 	org, err := d.client.GetOrgByName(d.cfg.VcdOrg)
 	if err != nil {
 		return err
@@ -87,6 +251,11 @@ func (d *VcdDriver) Create() error {
 		return err
 	}
 
+	log.Debug().
+		Str("alias", d.cfg.TemplateAlias).
+		Str("catalog", d.cfg.Catalog).
+		Str("template", d.cfg.Template).
+		Msg("Using template")
 	catalog, err := org.GetCatalogByName(d.cfg.Catalog, true)
 	if err != nil {
 		return err
@@ -153,40 +322,25 @@ func (d *VcdDriver) Create() error {
 
 	d.VMHREF = vm.VM.HREF
 
-	cWait := make(chan string, 1)
-	go func() {
-		for {
-			status, _ := vm.GetStatus()
-			if status == "POWERED_OFF" {
-				break
-			}
-			time.Sleep(5 * time.Second)
+	err = wait.Until(context.Background(), "vApp deployment", drivers.WaitConfig(d, "deploy", deployWait), func(ctx context.Context) error {
+		status, err := vm.GetStatus()
+		if err != nil {
+			return err
 		}
-
-		for {
-			vapp.Refresh()
-			if err != nil {
-				cWait <- "err"
-				return
-			}
-			if vapp.VApp.Tasks == nil {
-				time.Sleep(10) // let's give this old chap some time
-				break
-
-			}
-			time.Sleep(5 * time.Second)
+		if status != "POWERED_OFF" {
+			return fmt.Errorf("VM is %s", status)
 		}
 
-		cWait <- "ok"
-	}()
-
-	select {
-	case res := <-cWait:
-		if res == "err" {
-			return fmt.Errorf("error waiting for vApp deploy")
+		if err := vapp.Refresh(); err != nil {
+			return err
+		}
+		if vapp.VApp.Tasks != nil {
+			return fmt.Errorf("vApp has tasks running")
 		}
-	case <-time.After(15 * time.Minute):
-		return fmt.Errorf("reached timeout while deploying VM")
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	if vm.VM.VmSpecSection == nil {
@@ -237,9 +391,18 @@ func (d *VcdDriver) Create() error {
 	vm.VM.GuestCustomizationSection.AdminPasswordEnabled = &enabled
 	vm.VM.GuestCustomizationSection.AdminPasswordAuto = &disabled
 	vm.VM.GuestCustomizationSection.ResetPasswordRequired = &disabled
-	// vm.VM.GuestCustomizationSection.CustomizationScript = sshCustomScript
+	if d.hostname != "" {
+		vm.VM.GuestCustomizationSection.ComputerName = d.hostname
+	}
+	// os may not be set for the template, but the VM knows what it runs
+	machineOS, err := d.GetOS()
+	if err != nil {
+		return err
+	}
+	vm.VM.GuestCustomizationSection.CustomizationScript = customizationScript(machineOS, authorizedKey)
+	// waits for its own task, the key only gets in through this call
 	_, err = vm.SetGuestCustomizationSection(vm.VM.GuestCustomizationSection)
-	if err = task.WaitTaskCompletion(); err != nil {
+	if err != nil {
 		return err
 	}
 
@@ -252,41 +415,50 @@ func (d *VcdDriver) Create() error {
 		return err
 	}
 
+	if err := d.tagVApp(vapp); err != nil {
+		log.Warn().Err(err).Msg("Error tagging vApp")
+	}
+
 	d.VAppHREF = vapp.VApp.HREF
 	d.VMHREF = vm.VM.HREF
 
 	ip, err := d.GetIP()
-
-	log.Info().Msg("Waiting for the machine to be up")
-	err = d.waitForRDPStable(ip)
 	if err != nil {
 		return err
 	}
 
-	log.Info().Msgf("Waiting for SSH to be available")
-	for i := 0; i < 10; i++ {
-		// fmt.Printf("Attempt %d", i
-		err = drivers.WaitForSSH(d)
-	}
+	log.Info().Msg("Waiting for the machine to be ready")
+	err = d.waitUntilReady(ip, machineOS)
 	if err != nil {
 		return err
 	}
 
-	log.Debug().Msg("SSH is available")
+	log.Debug().Msg("The machine is ready")
 	return nil
 }
 
-func (d *VcdDriver) GetSSHClientFromDriver() (ssh.Client, error) {
+func (d *VcdDriver) GetCommunicator() (communicator.Communicator, error) {
+	return d.comm.Get(d.openCommunicator)
+}
+
+func (d *VcdDriver) openCommunicator() (communicator.Communicator, error) {
+	// the password still works if the template ignored the customization script
 	auth := ssh.Auth{
 		Passwords: []string{d.adminPassword},
+		HostKey:   d.hostKey,
+		OnHostKey: func(hostKey string) { d.hostKey = hostKey },
+		HostCAs:   d.cfg.SSHHostCAs,
+	}
+	if len(d.sshKey) > 0 {
+		auth.RawKeys = [][]byte{d.sshKey}
 	}
 
-	vm, err := d.getVM()
+	machineOS, err := d.GetOS()
 	if err != nil {
 		return nil, err
 	}
 	var user string
-	if strings.Contains(vm.VM.VmSpecSection.OsType, "windows") {
+	if machineOS == drivers.Windows {
 		user = "Administrator"
 	} else {
 		user = "root"
@@ -297,6 +469,14 @@ func (d *VcdDriver) GetSSHClientFromDriver() (ssh.Client, error) {
 		return nil, err
 	}
 
+	if d.cfg.Communicator == drivers.CommunicatorWinRM {
+		client, err := winrm.NewClient(user, d.adminPassword, ip, d.cfg.WinRM.GuestPort(), d.cfg.WinRM)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
 	client, err := ssh.NewClient(user, ip, SSHPort, &auth)
 	if err != nil {
 		return nil, err
@@ -304,12 +484,23 @@ func (d *VcdDriver) GetSSHClientFromDriver() (ssh.Client, error) {
 	return client, nil
 }
 
+// Close closes the connection to the machine, if there is one
+func (d *VcdDriver) Close() error {
+	return d.comm.Close()
+}
+
 func (d *VcdDriver) Destroy() error {
+	_ = d.Close()
+
 	vapp, err := d.getVApp()
 	if err != nil {
 		return err
 	}
 
+	return destroyVApp(vapp)
+}
+
+func destroyVApp(vapp *govcd.VApp) error {
 	task, err := vapp.PowerOff()
 	if err == nil {
 		log.Info().Msg("Powering off...")
@@ -337,18 +528,27 @@ func (d *VcdDriver) Destroy() error {
 }
 
 func (d *VcdDriver) GetOS() (drivers.OStype, error) {
+	if d.os != "" {
+		return d.os, nil
+	}
+
 	vm, err := d.getVM()
 	if err != nil {
 		return "", err
 	}
 	if strings.Contains(vm.VM.VmSpecSection.OsType, "windows") {
-		return drivers.Windows, nil
+		d.os = drivers.Windows
 	} else {
-		return drivers.Linux, nil
+		d.os = drivers.Linux
 	}
+	return d.os, nil
 }
 
 func (d *VcdDriver) GetIP() (string, error) {
+	if d.ip != "" {
+		return d.ip, nil
+	}
+
 	vm, err := d.getVM()
 	if err != nil {
 		return "", err
@@ -359,10 +559,12 @@ func (d *VcdDriver) GetIP() (string, error) {
 		networks := vm.VM.NetworkConnectionSection.NetworkConnection
 		for _, n := range networks {
 			if n.ExternalIPAddress != "" {
-				return n.ExternalIPAddress, nil
+				d.ip = n.ExternalIPAddress
+				return d.ip, nil
 			}
 			if n.IPAddress != "" { // perhaps this is too opinionated ?
-				return n.IPAddress, nil
+				d.ip = n.IPAddress
+				return d.ip, nil
 			}
 		}
 	}
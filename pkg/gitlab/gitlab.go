@@ -0,0 +1,64 @@
+package gitlab
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client is a minimal client of the GitLab REST API
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL string, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// JobStatus returns the status of a job (created, pending, running, success...)
+func (c *Client) JobStatus(projectID string, jobID string) (string, error) {
+	u := fmt.Sprintf("%s/api/v4/projects/%s/jobs/%s", c.baseURL, url.PathEscape(projectID), url.PathEscape(jobID))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitLab API returned %s for job %s of project %s", resp.Status, jobID, projectID)
+	}
+
+	var job struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return "", err
+	}
+	return job.Status, nil
+}
+
+// IsActive reports whether a job with that status may still use its machine
+func IsActive(status string) bool {
+	switch status {
+	case "created", "pending", "running", "waiting_for_resource", "preparing":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package naming
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+const (
+	DefaultMachineTemplate  = "gitlab-machine-{{ .CI_RUNNER_ID }}-project-{{ .CI_PROJECT_ID }}-concurrent-{{ .CI_CONCURRENT_PROJECT_ID }}-job-{{ .CI_JOB_ID }}"
+	DefaultHostnameTemplate = "gm-{{ .CI_JOB_ID }}"
+
+	// vCD limits vApp names to 128 characters
+	maxMachineNameLength = 128
+	// NetBIOS computer names, guest customization truncates longer ones
+	maxWindowsHostnameLength = 15
+	// a single DNS label
+	maxLinuxHostnameLength = 63
+
+	hashLength = 8
+)
+
+var (
+	invalidMachineNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	invalidHostnameChars    = regexp.MustCompile(`[^a-z0-9-]+`)
+	repeatedHyphens         = regexp.MustCompile(`-{2,}`)
+	onlyDigits              = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Config holds the Go templates used to name the machines. They can use any
+// CUSTOM_ENV_* variable without its prefix, e.g. {{ .CI_JOB_ID }}.
+type Config struct {
+	MachineTemplate  string `mapstructure:"machine"`
+	HostnameTemplate string `mapstructure:"hostname"`
+}
+
+// JobVariables returns the job variables GitLab passes to the executor as
+// CUSTOM_ENV_*, without the prefix
+func JobVariables() map[string]string {
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || !strings.HasPrefix(k, "CUSTOM_ENV_") {
+			continue
+		}
+		vars[strings.TrimPrefix(k, "CUSTOM_ENV_")] = v
+	}
+	return vars
+}
+
+// MachineName renders the machine (vApp, container, domain) name template.
+// The name must contain the job ID, so concurrent jobs never share a
+// machine name. Names too long are shortened with a hash of the full name,
+// so they stay unique.
+func (c Config) MachineName(vars map[string]string) (string, error) {
+	tmpl := c.MachineTemplate
+	if tmpl == "" {
+		tmpl = DefaultMachineTemplate
+	}
+
+	jobID := vars["CI_JOB_ID"]
+	if jobID == "" {
+		return "", fmt.Errorf("CI_JOB_ID is not set, machine names would not be unique")
+	}
+
+	name, err := render(tmpl, vars)
+	if err != nil {
+		return "", err
+	}
+
+	name = sanitize(invalidMachineNameChars.ReplaceAllString(name, "-"))
+	if !strings.Contains(name, jobID) {
+		return "", fmt.Errorf("machine name template %q must contain the job ID (CI_JOB_ID)", tmpl)
+	}
+	return shorten(name, maxMachineNameLength), nil
+}
+
+// Hostname renders the guest hostname template, following the naming rules
+// of the guest OS
+func (c Config) Hostname(vars map[string]string, machineOS drivers.OStype) (string, error) {
+	tmpl := c.HostnameTemplate
+	if tmpl == "" {
+		tmpl = DefaultHostnameTemplate
+	}
+
+	name, err := render(tmpl, vars)
+	if err != nil {
+		return "", err
+	}
+
+	name = sanitize(invalidHostnameChars.ReplaceAllString(strings.ToLower(name), "-"))
+	if name == "" {
+		return "", fmt.Errorf("hostname template %q renders to an empty name", tmpl)
+	}
+
+	if machineOS == drivers.Windows {
+		if onlyDigits.MatchString(name) {
+			return "", fmt.Errorf("hostname %q cannot be only digits on Windows", name)
+		}
+		return shorten(name, maxWindowsHostnameLength), nil
+	}
+	return shorten(name, maxLinuxHostnameLength), nil
+}
+
+// render executes tmpl, failing when a variable it always prints is missing
+// or empty, as the name would then be shared by several jobs
+func render(tmpl string, vars map[string]string) (string, error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range printedVariables(t.Tree.Root) {
+		if vars[name] == "" {
+			return "", fmt.Errorf("template %q uses %s, which is not set", tmpl, name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// printedVariables returns the variables the template always prints. The
+// ones in if, range or with blocks are left alone, their emptiness is
+// expected there.
+func printedVariables(root *parse.ListNode) []string {
+	var names []string
+	for _, node := range root.Nodes {
+		action, ok := node.(*parse.ActionNode)
+		if !ok {
+			continue
+		}
+		for _, cmd := range action.Pipe.Cmds {
+			for _, arg := range cmd.Args {
+				if f, ok := arg.(*parse.FieldNode); ok {
+					names = append(names, f.Ident[0])
+				}
+			}
+		}
+	}
+	return names
+}
+
+func sanitize(name string) string {
+	name = repeatedHyphens.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-.")
+}
+
+// shorten truncates name to max characters, replacing its end with a hash
+// of the full name
+func shorten(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:hashLength]
+	prefix := strings.TrimRight(name[:max-hashLength-1], "-.")
+	return fmt.Sprintf("%s-%s", prefix, hash)
+}
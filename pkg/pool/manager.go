@@ -0,0 +1,129 @@
+package pool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/state"
+)
+
+// CreateFunc creates and provisions a machine with the given name, returning
+// what the job needs to use it
+type CreateFunc func(name string) (*state.JobState, error)
+
+// Manager keeps a pool topped up with Size ready machines
+type Manager struct {
+	pool     *Pool
+	key      string
+	size     int
+	interval time.Duration
+	create   CreateFunc
+
+	mu       sync.Mutex
+	inflight int
+}
+
+func NewManager(p *Pool, key string, size int, interval time.Duration, create CreateFunc) *Manager {
+	return &Manager{
+		pool:     p,
+		key:      key,
+		size:     size,
+		interval: interval,
+		create:   create,
+	}
+}
+
+// Run refills the pool every interval until ctx is done. Machines being
+// created when ctx is done are still added to the pool.
+func (m *Manager) Run(ctx context.Context) error {
+	log.Info().Msgf("Keeping %d ready machines in pool %s", m.size, m.key)
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.refill(&wg); err != nil {
+			log.Error().Err(err).Msg("Error refilling the pool")
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Stopping pool, waiting for the machines being created")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) refill(wg *sync.WaitGroup) error {
+	ready, err := m.pool.Count(m.key)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	missing := m.size - ready - m.inflight
+	if missing > 0 {
+		m.inflight += missing
+	}
+	m.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				m.mu.Lock()
+				m.inflight--
+				m.mu.Unlock()
+			}()
+
+			name, err := MachineName(m.key)
+			if err != nil {
+				log.Error().Err(err).Msg("Error generating pool machine name")
+				return
+			}
+
+			log.Info().Msgf("Creating pool machine %s", name)
+			st, err := m.create(name)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error creating pool machine %s", name)
+				return
+			}
+
+			err = m.pool.Add(Machine{
+				Name:    name,
+				Key:     m.key,
+				ReadyAt: time.Now(),
+				State:   *st,
+			})
+			if err != nil {
+				log.Error().Err(err).Msgf("Error adding %s to the pool", name)
+				return
+			}
+			log.Info().Msgf("Pool machine %s is ready", name)
+		}()
+	}
+	return nil
+}
+
+// MachinePrefix starts the names of the machines created for the pools
+const MachinePrefix = "gitlab-machine-pool-"
+
+// MachineName returns a new random name for a machine of the pool key
+func MachineName(key string) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%s-%s", MachinePrefix, key, hex.EncodeToString(suffix)), nil
+}
@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/state"
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+)
+
+const (
+	ErrPoolEmpty = utils.Error("no ready machine in the pool")
+)
+
+// Machine is a ready, already provisioned machine waiting to be claimed by a job
+type Machine struct {
+	Name    string         `json:"name"`
+	Key     string         `json:"key"` // pool the machine belongs to
+	ReadyAt time.Time      `json:"ready_at"`
+	State   state.JobState `json:"state"`
+}
+
+// Pool keeps the ready machines in a JSON file shared by the pool daemon,
+// which adds them, and the prepare stages of the jobs, which claim them
+type Pool struct {
+	path string
+}
+
+func New(path string) *Pool {
+	return &Pool{path: path}
+}
+
+func (p *Pool) Add(m Machine) error {
+	return p.update(func(machines []Machine) ([]Machine, error) {
+		return append(machines, m), nil
+	})
+}
+
+// Claim takes the oldest ready machine out of the pool. A claimed machine
+// belongs to the job from then on, and it is destroyed after it.
+func (p *Pool) Claim(key string) (*Machine, error) {
+	var claimed *Machine
+	err := p.update(func(machines []Machine) ([]Machine, error) {
+		for i, m := range machines {
+			if m.Key != key {
+				continue
+			}
+			claimed = &m
+			return append(machines[:i], machines[i+1:]...), nil
+		}
+		return nil, ErrPoolEmpty
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// List returns the ready machines of every pool
+func (p *Pool) List() ([]Machine, error) {
+	var list []Machine
+	err := p.update(func(machines []Machine) ([]Machine, error) {
+		list = append(list, machines...)
+		return machines, nil
+	})
+	return list, err
+}
+
+// Count returns how many ready machines there are in the pool
+func (p *Pool) Count(key string) (int, error) {
+	count := 0
+	err := p.update(func(machines []Machine) ([]Machine, error) {
+		for _, m := range machines {
+			if m.Key == key {
+				count++
+			}
+		}
+		return machines, nil
+	})
+	return count, err
+}
+
+// update runs f with the pool locked, saving the machines it returns
+func (p *Pool) update(f func([]Machine) ([]Machine, error)) error {
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		return err
+	}
+
+	unlock, err := state.Lock(p.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	machines := []Machine{}
+	data, err := os.ReadFile(p.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &machines); err != nil {
+			return err
+		}
+	}
+
+	machines, err = f(machines)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(machines, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
@@ -0,0 +1,215 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
+
+// Types of the probes every driver supports. Drivers can add their own
+// through Target.Custom.
+const (
+	TypeTCP   = "tcp"
+	TypeSSH   = "ssh"
+	TypeWinRM = "winrm"
+	TypeHTTP  = "http"
+)
+
+const (
+	dialTimeout    = 3 * time.Second
+	requestTimeout = 10 * time.Second
+
+	winRMPort    = 5985
+	winRMTLSPort = 5986
+)
+
+// DefaultWait is used for the fields the probes and the drivers leave unset
+var DefaultWait = wait.Config{
+	Timeout:     30 * time.Minute,
+	Interval:    5 * time.Second,
+	MaxInterval: 30 * time.Second,
+	Successes:   1,
+}
+
+// Config of a readiness probe. A tcp probe with successes > 1 checks that
+// the port stays open, e.g. RDP while Windows reboots during customization.
+type Config struct {
+	Type string `mapstructure:"type"`
+	Port int    `mapstructure:"port"`
+	// http and winrm
+	TLS bool `mapstructure:"tls"`
+	// http
+	Path   string `mapstructure:"path"`
+	Status int    `mapstructure:"status"` // expected, defaults to 200
+	// ssh, defaults to exit
+	Command string `mapstructure:"command"`
+
+	Wait wait.Config `mapstructure:",squash"`
+}
+
+func (c Config) String() string {
+	if c.Port != 0 {
+		return fmt.Sprintf("%s probe on port %d", c.Type, c.Port)
+	}
+	return fmt.Sprintf("%s probe", c.Type)
+}
+
+// Target is the machine being probed
+type Target struct {
+	Host string
+	// SSH runs command on the machine until it exits or ctx is done, for
+	// ssh probes
+	SSH func(ctx context.Context, command string) error
+	// Custom are the probes only the driver knows how to run, by type
+	Custom map[string]wait.Condition
+}
+
+// Wait runs the probes one after the other, until all of them pass
+func Wait(ctx context.Context, probes []Config, target Target) error {
+	for _, p := range probes {
+		cond, err := condition(p, target)
+		if err != nil {
+			return err
+		}
+
+		log.Info().Msgf("Waiting for the %s", p)
+		if err := wait.Until(ctx, p.String(), p.Wait.WithDefaults(DefaultWait), cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks the probes can run, given the custom probes of the driver
+func Validate(probes []Config, custom ...string) error {
+	for _, p := range probes {
+		switch p.Type {
+		case TypeTCP:
+			if p.Port == 0 {
+				return fmt.Errorf("the %s needs a port", p)
+			}
+		case TypeSSH, TypeWinRM, TypeHTTP:
+		default:
+			if !contains(custom, p.Type) {
+				return fmt.Errorf("unknown probe type %q", p.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func condition(p Config, target Target) (wait.Condition, error) {
+	switch p.Type {
+	case TypeTCP:
+		if p.Port == 0 {
+			return nil, fmt.Errorf("the %s needs a port", p)
+		}
+		return tcpCondition(target.Host, p.Port), nil
+
+	case TypeSSH:
+		if target.SSH == nil {
+			return nil, fmt.Errorf("the driver does not support ssh probes")
+		}
+		command := p.Command
+		if command == "" {
+			command = "exit"
+		}
+		return func(ctx context.Context) error {
+			return target.SSH(ctx, command)
+		}, nil
+
+	case TypeWinRM:
+		port, scheme := winRMPort, "http"
+		if p.TLS {
+			port, scheme = winRMTLSPort, "https"
+		}
+		if p.Port != 0 {
+			port = p.Port
+		}
+		// the listener answers 405 to a GET, any answer means it is up
+		return httpCondition(fmt.Sprintf("%s://%s/wsman", scheme, hostPort(target.Host, port)), 0), nil
+
+	case TypeHTTP:
+		scheme := "http"
+		if p.TLS {
+			scheme = "https"
+		}
+		port := p.Port
+		if port == 0 {
+			port = 80
+			if p.TLS {
+				port = 443
+			}
+		}
+		status := p.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		return httpCondition(fmt.Sprintf("%s://%s%s", scheme, hostPort(target.Host, port), p.Path), status), nil
+	}
+
+	if cond, ok := target.Custom[p.Type]; ok {
+		return cond, nil
+	}
+	return nil, fmt.Errorf("unknown probe type %q", p.Type)
+}
+
+func tcpCondition(host string, port int) wait.Condition {
+	addr := hostPort(host, port)
+	return func(ctx context.Context) error {
+		dialer := net.Dialer{Timeout: dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return fmt.Errorf("nothing listening in %s yet: %w", addr, err)
+		}
+		return conn.Close()
+	}
+}
+
+// httpCondition GETs url, expecting the given status. Zero accepts any.
+func httpCondition(url string, status int) wait.Condition {
+	client := http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			// guests use self-signed certificates until they are provisioned
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+		},
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if status != 0 && resp.StatusCode != status {
+			return fmt.Errorf("%s answered %d, expecting %d", url, resp.StatusCode, status)
+		}
+		return nil
+	}
+}
+
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
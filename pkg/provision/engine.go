@@ -0,0 +1,341 @@
+package provision
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
+
+const (
+	ErrStepTimeout  = utils.Error("provisioning step timed out")
+	ErrNotRebooted  = utils.Error("the machine has not rebooted yet")
+	windowsBootTime = `powershell -NoProfile -Command "(Get-CimInstance Win32_OperatingSystem).LastBootUpTime.ToFileTimeUtc()"`
+	linuxBootID     = "cat /proc/sys/kernel/random/boot_id"
+)
+
+const (
+	// bound the commands that must not hang the provisioning
+	checkTimeout = 2 * time.Minute
+	killTimeout  = 2 * time.Minute
+
+	// failed attempts back off from retryDelay, doubling up to maxRetryDelay
+	retryDelay    = 10 * time.Second
+	maxRetryDelay = 2 * time.Minute
+)
+
+// linuxPackageInstallCommands installs packages with each supported package manager
+var linuxPackageInstallCommands = map[string]string{
+	"apt-get": "export DEBIAN_FRONTEND=noninteractive; apt-get update -q && apt-get install -y -q %s",
+	"dnf":     "dnf install -y %s",
+	"zypper":  "zypper --non-interactive install %s",
+	"apk":     "apk add --no-cache %s",
+}
+
+// Engine runs provisioning steps on the machine of a driver
+type Engine struct {
+	driver         drivers.Driver
+	os             drivers.OStype
+	packageManager string
+	// marker tags the commands of the step being run, so they can be
+	// killed when it times out
+	marker string
+}
+
+func NewEngine(d drivers.Driver) (*Engine, error) {
+	machineOS, err := d.GetOS()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Engine{
+		driver: d,
+		os:     machineOS,
+	}, nil
+}
+
+// Run converges the machine: it first runs the checks of every step, and then
+// executes in order the steps whose check fails (or that have no check),
+// retrying the failed ones. It stops at the first step that keeps failing,
+// unless the step ignores its errors.
+func (e *Engine) Run(steps []Step) error {
+	for i, step := range steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("provisioning step %d (%s): %w", i+1, step, err)
+		}
+	}
+
+	pending := []Step{}
+	for _, step := range steps {
+		if step.Check != nil && e.checkPasses(*step.Check) {
+			log.Debug().Msgf("Provisioning step %s already satisfied, skipping", step)
+			continue
+		}
+		pending = append(pending, step)
+	}
+
+	if len(pending) == 0 {
+		log.Info().Msg("Machine already provisioned, skipping bootstrap")
+		return nil
+	}
+
+	for i, step := range pending {
+		log.Info().Msgf("Provisioning step %d/%d: %s", i+1, len(pending), step)
+
+		var err error
+		delay := retryDelay
+		for attempt := 0; attempt <= step.Retries; attempt++ {
+			if attempt > 0 {
+				log.Warn().Err(err).Msgf("Retrying provisioning step in %s (attempt %d out of %d)", delay, attempt+1, step.Retries+1)
+				time.Sleep(delay)
+				if delay *= 2; delay > maxRetryDelay {
+					delay = maxRetryDelay
+				}
+			}
+			err = e.runStepWithTimeout(step)
+			if err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			if step.IgnoreErrors {
+				log.Warn().Err(err).Msgf("Provisioning step %s failed, ignoring", step)
+				continue
+			}
+			return fmt.Errorf("provisioning step %d (%s) failed: %w", i+1, step, err)
+		}
+	}
+	return nil
+}
+
+// runStepWithTimeout runs the step. When its timeout expires, the commands of
+// the step are killed along with whatever they started, since cancelling the
+// remote command does not reach the children of installers on Windows.
+func (e *Engine) runStepWithTimeout(step Step) error {
+	if step.Timeout <= 0 {
+		return e.runStep(context.Background(), step)
+	}
+
+	marker, err := newMarker()
+	if err != nil {
+		return err
+	}
+	e.marker = marker
+	defer func() { e.marker = "" }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), step.Timeout)
+	defer cancel()
+
+	err = e.runStep(ctx, step)
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+
+	log.Warn().Msgf("Provisioning step %s timed out, killing its processes", step)
+	killCtx, cancelKill := context.WithTimeout(context.Background(), killTimeout)
+	defer cancelKill()
+	if _, err := e.commandOutput(killCtx, drivers.KillCommand(e.os, marker)); err != nil {
+		log.Error().Err(err).Msg("Error killing the processes of the step")
+	}
+	return fmt.Errorf("%w after %s", ErrStepTimeout, step.Timeout)
+}
+
+// newMarker returns a string unique to a step attempt
+func newMarker() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "gitlab-machine-step-" + hex.EncodeToString(b), nil
+}
+
+// mark tags command with the marker of the current step, as a no-op the
+// shell ignores but that shows up in its command line
+func (e *Engine) mark(command string) string {
+	if e.marker == "" {
+		return command
+	}
+	if e.os == drivers.Windows {
+		return fmt.Sprintf("$null = '%s'; %s", e.marker, command)
+	}
+	return fmt.Sprintf(": %s; %s", e.marker, command)
+}
+
+func (e *Engine) runStep(ctx context.Context, step Step) error {
+	switch {
+	case step.Run != "":
+		return e.runCommand(ctx, step.Run)
+	case len(step.Packages) > 0:
+		return e.installPackages(ctx, step.Packages)
+	case step.Upload != "":
+		c, err := e.driver.GetCommunicator()
+		if err != nil {
+			return err
+		}
+		return c.Upload(step.Upload, step.Destination)
+	default:
+		return e.reboot(ctx)
+	}
+}
+
+// checkPasses reports whether the probe succeeds on the guest. Any error,
+// including not being able to run it, counts as a failed check.
+func (e *Engine) checkPasses(c Check) bool {
+	var cmd string
+	switch {
+	case c.Command != "":
+		cmd = c.Command
+	case c.File != "":
+		if e.os == drivers.Windows {
+			cmd = testPathCommand(c.File)
+		} else {
+			cmd = fmt.Sprintf("test -e '%s'", c.File)
+		}
+	default:
+		if e.os != drivers.Windows {
+			log.Warn().Str("registry", c.Registry).Msg("Registry checks are only supported on Windows")
+			return false
+		}
+		cmd = testPathCommand(c.Registry)
+	}
+
+	comm, err := e.driver.GetCommunicator()
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	log.Debug().Str("command", cmd).Msg("Running check")
+	output, err := communicator.Output(ctx, comm, cmd)
+	if err != nil {
+		log.Debug().Err(err).Str("output", output).Msg("Check failed")
+		return false
+	}
+	return true
+}
+
+// testPathCommand works for both files and registry keys, and does not
+// depend on the default SSH shell of the guest
+func testPathCommand(path string) string {
+	return fmt.Sprintf(`powershell -NoProfile -Command "if (!(Test-Path -LiteralPath '%s')) { exit 1 }"`, path)
+}
+
+func (e *Engine) installPackages(ctx context.Context, packages []string) error {
+	if e.os == drivers.Windows {
+		return e.runCommand(ctx, fmt.Sprintf("choco install -y --no-progress %s;", strings.Join(packages, " ")))
+	}
+
+	if e.packageManager == "" {
+		pm, err := e.detectPackageManager(ctx)
+		if err != nil {
+			return err
+		}
+		log.Debug().Str("package_manager", pm).Msg("Detected package manager")
+		e.packageManager = pm
+	}
+
+	return e.runCommand(ctx, fmt.Sprintf(linuxPackageInstallCommands[e.packageManager], strings.Join(packages, " ")))
+}
+
+func (e *Engine) detectPackageManager(ctx context.Context) (string, error) {
+	output, err := e.commandOutput(ctx, `for pm in apt-get dnf zypper apk; do if command -v $pm >/dev/null 2>&1; then echo $pm; exit 0; fi; done; exit 1`)
+	if err != nil {
+		return "", fmt.Errorf("no supported package manager found: %w", err)
+	}
+
+	pm := strings.TrimSpace(output)
+	if _, ok := linuxPackageInstallCommands[pm]; !ok {
+		return "", fmt.Errorf("unsupported package manager %q", pm)
+	}
+	return pm, nil
+}
+
+// reboot restarts the guest and waits until it is back, i.e. until it
+// answers with another boot ID
+func (e *Engine) reboot(ctx context.Context) error {
+	before, err := e.bootID(ctx)
+	if err != nil {
+		return err
+	}
+
+	cmd := "nohup sh -c 'sleep 2; reboot' >/dev/null 2>&1 &"
+	if e.os == drivers.Windows {
+		cmd = "shutdown /r /f /t 2"
+	}
+
+	// the connection may drop before the command returns
+	if _, err := e.commandOutput(ctx, cmd); err != nil {
+		log.Debug().Err(err).Msg("Error requesting reboot")
+	}
+
+	log.Info().Msg("Waiting for the machine to reboot")
+	return wait.Until(ctx, "reboot", drivers.WaitConfig(e.driver, "ssh", drivers.SSHWait), func(ctx context.Context) error {
+		id, err := e.bootID(ctx)
+		if err != nil {
+			return err
+		}
+		if id == before {
+			return ErrNotRebooted
+		}
+		return nil
+	})
+}
+
+// bootID returns what changes every time the guest boots
+func (e *Engine) bootID(ctx context.Context) (string, error) {
+	cmd := linuxBootID
+	if e.os == drivers.Windows {
+		cmd = windowsBootTime
+	}
+
+	c, err := e.driver.GetCommunicator()
+	if err != nil {
+		return "", err
+	}
+	output, err := communicator.Output(ctx, c, cmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+func (e *Engine) runCommand(ctx context.Context, command string) error {
+	_, err := e.commandOutput(ctx, e.mark(command))
+	return err
+}
+
+func (e *Engine) commandOutput(ctx context.Context, command string) (string, error) {
+	c, err := e.driver.GetCommunicator()
+	if err != nil {
+		return "", err
+	}
+
+	log.Debug().Str("command", command).Msg("Running command")
+
+	output, err := communicator.Output(ctx, c, command)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("command", command).
+			Str("output", output).
+			Msg("Error running command")
+		return "", fmt.Errorf("remote command error: %w", err)
+	}
+
+	log.Debug().Str("output", output).Msg("Command executed successfully")
+
+	return output, nil
+}
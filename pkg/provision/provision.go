@@ -0,0 +1,178 @@
+package provision
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/drivers"
+)
+
+const (
+	gitlabRunnerDownloadURL = "https://gitlab-runner-downloads.s3.amazonaws.com/latest/binaries/gitlab-runner-linux-$arch"
+)
+
+// Check probes whether a step is already satisfied on the guest, e.g. because
+// the template is golden. Exactly one of its fields must be set.
+type Check struct {
+	Command  string `mapstructure:"command"`
+	File     string `mapstructure:"file"`
+	Registry string `mapstructure:"registry"` // Windows only
+}
+
+// Step is a single provisioning action. Exactly one of Run, Packages,
+// Upload or Reboot must be set. Steps with a Check only run when it fails.
+type Step struct {
+	Name  string `mapstructure:"name"`
+	Check *Check `mapstructure:"check"`
+
+	Run         string   `mapstructure:"run"`
+	Packages    []string `mapstructure:"packages"`
+	Upload      string   `mapstructure:"upload"`
+	Destination string   `mapstructure:"destination"`
+	Reboot      bool     `mapstructure:"reboot"`
+
+	// Timeout kills the commands of the step, and whatever they started,
+	// when it expires. It does not apply to uploads. On Windows, the
+	// commands of steps with a timeout must run in PowerShell.
+	Timeout      time.Duration `mapstructure:"timeout"`
+	Retries      int           `mapstructure:"retries"`
+	IgnoreErrors bool          `mapstructure:"ignore_errors"`
+}
+
+// Config holds the ordered provisioning steps for each guest OS. When the
+// steps of an OS are not configured, the defaults are used.
+type Config struct {
+	Windows []Step `mapstructure:"windows"`
+	Linux   []Step `mapstructure:"linux"`
+}
+
+// DefaultWindowsSteps sets PowerShell as the SSH shell and installs the
+// tools required by the jobs with Chocolatey. The SSH steps are skipped on
+// guests without OpenSSH, reached over WinRM.
+var DefaultWindowsSteps = []Step{
+	{
+		Name:  "Set PowerShell as the default SSH shell",
+		Check: &Check{Command: `powershell -NoProfile -Command "if ((Test-Path 'HKLM:\SOFTWARE\OpenSSH') -and (Get-ItemProperty -Path 'HKLM:\SOFTWARE\OpenSSH').DefaultShell -notlike '*powershell.exe') { exit 1 }"`},
+		Run:   `powershell New-ItemProperty -Path "HKLM:\SOFTWARE\OpenSSH" -Name DefaultShell -Value "C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe" -PropertyType String -Force`,
+	},
+	{Name: "Install git", Check: &Check{Command: "git --version"}, Packages: []string{"git.install"}},
+	{Name: "Refresh environment", Check: &Check{Command: "git --version"}, Run: "refreshenv;"},
+	{Name: "Install posh-git", Check: &Check{File: `C:\tools\poshgit`}, Packages: []string{"poshgit"}},
+	{Name: "Install gitlab-runner", Check: &Check{Command: "gitlab-runner --version"}, Packages: []string{"gitlab-runner"}},
+	{
+		// sshd only picks up the new PATH after a restart
+		Name:  "Restart sshd",
+		Check: &Check{Command: "gitlab-runner --version"},
+		Run:   "if (Get-Service sshd -ErrorAction SilentlyContinue) { Restart-Service -force sshd }", // https://github.com/chocolatey/choco/issues/2694
+	},
+}
+
+// DefaultLinuxSteps installs git, git-lfs and the gitlab-runner binary (used as
+// the artifacts and cache helper). bash runs the job scripts, and it is not
+// there by default on Alpine.
+var DefaultLinuxSteps = []Step{
+	{
+		Name:     "Install git",
+		Check:    &Check{Command: "bash --version && curl --version && git lfs version"},
+		Packages: []string{"bash", "ca-certificates", "curl", "git", "git-lfs"},
+	},
+	{
+		Name:  "Enable git-lfs",
+		Check: &Check{Command: "git config --system --get filter.lfs.process"},
+		Run:   "git lfs install --system",
+	},
+	{
+		// packages.gitlab.com does not cover every distro, the static binary works everywhere
+		Name:  "Install gitlab-runner",
+		Check: &Check{Command: "gitlab-runner --version"},
+		Run: `case "$(uname -m)" in aarch64|arm64) arch=arm64 ;; *) arch=amd64 ;; esac; ` +
+			`curl -sSfL -o /usr/local/bin/gitlab-runner "` + gitlabRunnerDownloadURL + `" && chmod +x /usr/local/bin/gitlab-runner`,
+	},
+}
+
+// StepsFor returns the steps to run on a guest with the given OS
+func (c Config) StepsFor(machineOS drivers.OStype) []Step {
+	if machineOS == drivers.Windows {
+		if c.Windows == nil {
+			return DefaultWindowsSteps
+		}
+		return c.Windows
+	}
+
+	if c.Linux == nil {
+		return DefaultLinuxSteps
+	}
+	return c.Linux
+}
+
+// Validate checks that every step does exactly one thing
+func (c Config) Validate() error {
+	for _, steps := range [][]Step{c.Windows, c.Linux} {
+		for i, s := range steps {
+			if err := s.validate(); err != nil {
+				return fmt.Errorf("provisioning step %d (%s): %w", i+1, s, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	actions := 0
+	if s.Run != "" {
+		actions++
+	}
+	if len(s.Packages) > 0 {
+		actions++
+	}
+	if s.Upload != "" {
+		actions++
+		if s.Destination == "" {
+			return fmt.Errorf("upload requires a destination")
+		}
+	}
+	if s.Reboot {
+		actions++
+	}
+
+	if actions != 1 {
+		return fmt.Errorf("a step must have exactly one of run, packages, upload or reboot")
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("retries cannot be negative")
+	}
+	if s.Check != nil {
+		return s.Check.validate()
+	}
+	return nil
+}
+
+func (c Check) validate() error {
+	probes := 0
+	for _, p := range []string{c.Command, c.File, c.Registry} {
+		if p != "" {
+			probes++
+		}
+	}
+	if probes != 1 {
+		return fmt.Errorf("a check must have exactly one of command, file or registry")
+	}
+	return nil
+}
+
+// String returns a human readable description of the step for the logs
+func (s Step) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	switch {
+	case s.Run != "":
+		return s.Run
+	case len(s.Packages) > 0:
+		return fmt.Sprintf("install %v", s.Packages)
+	case s.Upload != "":
+		return fmt.Sprintf("upload %s", s.Upload)
+	default:
+		return "reboot"
+	}
+}
@@ -0,0 +1,134 @@
+package sizing
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CI variables jobs use to ask for a machine size
+const (
+	ClassVariable    = "CUSTOM_ENV_GITLAB_MACHINE_SIZE"
+	CpusVariable     = "CUSTOM_ENV_GITLAB_MACHINE_CPUS"
+	MemoryMbVariable = "CUSTOM_ENV_GITLAB_MACHINE_MEMORY_MB"
+)
+
+// Size of a machine. Zero values are left as configured in the driver.
+type Size struct {
+	Cpus           int `mapstructure:"cpus"`
+	CoresPerSocket int `mapstructure:"cores_per_socket"`
+	MemoryMb       int `mapstructure:"memory_mb"`
+}
+
+// Config holds what jobs are allowed to ask for. Jobs can pick one of the
+// classes, and set the CPUs or the memory themselves only when their max is
+// set.
+type Config struct {
+	Classes map[string]Size `mapstructure:"classes"`
+	Min     Size            `mapstructure:"min"`
+	Max     Size            `mapstructure:"max"`
+}
+
+// Requested tells whether the job asked for a size of its own
+func Requested() bool {
+	for _, env := range []string{ClassVariable, CpusVariable, MemoryMbVariable} {
+		if os.Getenv(env) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve applies the size requested by the job on top of the size set in
+// the driver config, and checks it is within the limits. defaultClass is
+// used when the job does not pick a class.
+func (c Config) Resolve(base Size, defaultClass string) (Size, error) {
+	size := base
+
+	class := os.Getenv(ClassVariable)
+	if class == "" {
+		class = defaultClass
+	}
+	if class != "" {
+		// viper lowercases the keys of the config
+		s, ok := c.Classes[strings.ToLower(class)]
+		if !ok {
+			return Size{}, fmt.Errorf("unknown size class %q (allowed: %v)", class, c.classNames())
+		}
+		size = size.merge(s)
+	}
+
+	custom := Size{}
+	for _, v := range []struct {
+		env   string
+		max   int
+		value *int
+	}{
+		{CpusVariable, c.Max.Cpus, &custom.Cpus},
+		{MemoryMbVariable, c.Max.MemoryMb, &custom.MemoryMb},
+	} {
+		env := v.env
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+		// without a max, nothing would stop a job from taking the whole VDC
+		if v.max == 0 {
+			return Size{}, fmt.Errorf("%s is not allowed, use a size class (allowed: %v)", env, c.classNames())
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			return Size{}, fmt.Errorf("invalid %s %q", env, raw)
+		}
+		*v.value = n
+	}
+	size = size.merge(custom)
+
+	if err := c.check(size); err != nil {
+		return Size{}, err
+	}
+	return size, nil
+}
+
+func (c Config) check(size Size) error {
+	if c.Min.Cpus > 0 && size.Cpus < c.Min.Cpus {
+		return fmt.Errorf("%d CPUs is below the minimum of %d", size.Cpus, c.Min.Cpus)
+	}
+	if c.Max.Cpus > 0 && size.Cpus > c.Max.Cpus {
+		return fmt.Errorf("%d CPUs is above the maximum of %d", size.Cpus, c.Max.Cpus)
+	}
+	if c.Min.MemoryMb > 0 && size.MemoryMb < c.Min.MemoryMb {
+		return fmt.Errorf("%d MB of memory is below the minimum of %d", size.MemoryMb, c.Min.MemoryMb)
+	}
+	if c.Max.MemoryMb > 0 && size.MemoryMb > c.Max.MemoryMb {
+		return fmt.Errorf("%d MB of memory is above the maximum of %d", size.MemoryMb, c.Max.MemoryMb)
+	}
+	if size.CoresPerSocket > 0 && size.Cpus%size.CoresPerSocket != 0 {
+		return fmt.Errorf("%d CPUs is not a multiple of %d cores per socket", size.Cpus, size.CoresPerSocket)
+	}
+	return nil
+}
+
+func (c Config) classNames() []string {
+	names := make([]string, 0, len(c.Classes))
+	for name := range c.Classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s Size) merge(o Size) Size {
+	if o.Cpus > 0 {
+		s.Cpus = o.Cpus
+	}
+	if o.CoresPerSocket > 0 {
+		s.CoresPerSocket = o.CoresPerSocket
+	}
+	if o.MemoryMb > 0 {
+		s.MemoryMb = o.MemoryMb
+	}
+	return s
+}
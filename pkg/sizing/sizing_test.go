@@ -0,0 +1,117 @@
+package sizing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	cfg := Config{
+		Classes: map[string]Size{
+			"small": {Cpus: 2, MemoryMb: 4096},
+			"large": {Cpus: 16, CoresPerSocket: 8, MemoryMb: 32768},
+			"huge":  {Cpus: 32, MemoryMb: 65536},
+		},
+		Min: Size{Cpus: 2, MemoryMb: 2048},
+		Max: Size{Cpus: 16, MemoryMb: 32768},
+	}
+	base := Size{Cpus: 4, MemoryMb: 8192}
+
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		cfg     *Config
+		want    Size
+		wantErr string
+	}{
+		{
+			name: "driver size without a request",
+			want: base,
+		},
+		{
+			name: "class",
+			env:  map[string]string{ClassVariable: "Large"},
+			want: Size{Cpus: 16, CoresPerSocket: 8, MemoryMb: 32768},
+		},
+		{
+			name:    "unknown class",
+			env:     map[string]string{ClassVariable: "medium"},
+			wantErr: `unknown size class "medium"`,
+		},
+		{
+			name:    "class above the max",
+			env:     map[string]string{ClassVariable: "huge"},
+			wantErr: "32 CPUs is above the maximum of 16",
+		},
+		{
+			name: "CPUs and memory at the limits",
+			env:  map[string]string{CpusVariable: "16", MemoryMbVariable: "2048"},
+			want: Size{Cpus: 16, MemoryMb: 2048},
+		},
+		{
+			name:    "CPUs below the min",
+			env:     map[string]string{CpusVariable: "1"},
+			wantErr: "1 CPUs is below the minimum of 2",
+		},
+		{
+			name:    "CPUs above the max",
+			env:     map[string]string{CpusVariable: "17"},
+			wantErr: "17 CPUs is above the maximum of 16",
+		},
+		{
+			name:    "memory below the min",
+			env:     map[string]string{MemoryMbVariable: "1024"},
+			wantErr: "1024 MB of memory is below the minimum of 2048",
+		},
+		{
+			name:    "memory above the max",
+			env:     map[string]string{MemoryMbVariable: "65536"},
+			wantErr: "65536 MB of memory is above the maximum of 32768",
+		},
+		{
+			name:    "invalid CPUs",
+			env:     map[string]string{CpusVariable: "many"},
+			wantErr: `invalid ` + CpusVariable + ` "many"`,
+		},
+		{
+			name:    "CPUs without a max",
+			env:     map[string]string{CpusVariable: "8"},
+			cfg:     &Config{Classes: cfg.Classes},
+			wantErr: CpusVariable + " is not allowed",
+		},
+		{
+			name: "CPUs in sockets of the class",
+			env:  map[string]string{ClassVariable: "large", CpusVariable: "8"},
+			want: Size{Cpus: 8, CoresPerSocket: 8, MemoryMb: 32768},
+		},
+		{
+			name:    "CPUs not a multiple of the cores per socket",
+			env:     map[string]string{ClassVariable: "large", CpusVariable: "12"},
+			wantErr: "12 CPUs is not a multiple of 8 cores per socket",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, env := range []string{ClassVariable, CpusVariable, MemoryMbVariable} {
+				t.Setenv(env, tc.env[env])
+			}
+			c := cfg
+			if tc.cfg != nil {
+				c = *tc.cfg
+			}
+
+			got, err := c.Resolve(base, "")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("size = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
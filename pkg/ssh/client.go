@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -8,48 +9,69 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
 	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
 	"github.com/moby/term"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 const (
 	ErrCreatingNativeGoClient = utils.Error("Error creating native Go SSH client")
 )
 
+const (
+	keepAliveInterval = 15 * time.Second
+	keepAliveTimeout  = 30 * time.Second
+
+	// bounds each attempt to connect and complete the handshake, so
+	// machines that accept connections but never answer are retried
+	dialTimeout = 15 * time.Second
+)
+
+// dialWait covers short network hiccups, waiting for machines to boot is up
+// to the drivers
+var dialWait = wait.Config{
+	Timeout:     3 * time.Minute,
+	Interval:    time.Second,
+	MaxInterval: 10 * time.Second,
+}
+
 type Auth struct {
 	Passwords []string
-	Keys      []string
+	// Keys are paths to private key files
+	Keys []string
+	// RawKeys are PEM encoded private keys
+	RawKeys [][]byte
+
+	// HostKey is the host key pinned for the machine, in authorized_keys
+	// format. When empty, the key of the first authenticated connection is
+	// trusted and passed to OnHostKey, so it can be pinned for the next ones.
+	HostKey   string
+	OnHostKey func(hostKey string)
+	// HostCAs are the CAs, in authorized_keys format, whose host
+	// certificates are trusted. They take precedence over HostKey.
+	HostCAs []string
 }
 
+// Client reaches a machine over SSH, uploading and downloading files over
+// SFTP
 type Client interface {
-	Output(command string) (string, error)
-	OutputWithPty(command string) (string, error)
-	Shell(args ...string) error
-
-	// Start starts the specified command without waiting for it to finish. You
-	// have to call the Wait function for that.
-	//
-	// The first two io.ReadCloser are the standard output and the standard
-	// error of the executing command respectively. The returned error follows
-	// the same logic as in the exec.Cmd.Start function.
-	Start(command string) (io.ReadCloser, io.ReadCloser, error)
-
-	// Wait waits for the command started by the Start function to exit. The
-	// returned error follows the same logic as in the exec.Cmd.Wait function.
-	Wait() error
+	communicator.Communicator
 }
 
 type NativeClient struct {
-	Config      ssh.ClientConfig
-	Hostname    string
-	Port        int
-	openSession *ssh.Session
-	openClient  *ssh.Client
+	Config   ssh.ClientConfig
+	Hostname string
+	Port     int
+	tofu     *trustOnFirstUse
+
+	mu   sync.Mutex
+	conn *ssh.Client
 }
 
 func NewClient(user string, host string, port int, auth *Auth) (Client, error) {
@@ -58,7 +80,7 @@ func NewClient(user string, host string, port int, auth *Auth) (Client, error) {
 }
 
 func NewNativeClient(user, host string, port int, auth *Auth) (Client, error) {
-	config, err := NewNativeConfig(user, auth)
+	config, tofu, err := newNativeConfig(user, auth)
 	if err != nil {
 		log.Error().Err(err).Msg("Error creating SSH client config")
 		return nil, ErrCreatingNativeGoClient
@@ -68,10 +90,18 @@ func NewNativeClient(user, host string, port int, auth *Auth) (Client, error) {
 		Config:   config,
 		Hostname: host,
 		Port:     port,
+		tofu:     tofu,
 	}, nil
 }
 
+// NewNativeConfig returns the config to connect with. Host keys seen on
+// first use are not pinned, that needs a NativeClient.
 func NewNativeConfig(user string, auth *Auth) (ssh.ClientConfig, error) {
+	config, _, err := newNativeConfig(user, auth)
+	return config, err
+}
+
+func newNativeConfig(user string, auth *Auth) (ssh.ClientConfig, *trustOnFirstUse, error) {
 	var (
 		authMethods []ssh.AuthMethod
 	)
@@ -79,12 +109,21 @@ func NewNativeConfig(user string, auth *Auth) (ssh.ClientConfig, error) {
 	for _, k := range auth.Keys {
 		key, err := ioutil.ReadFile(k)
 		if err != nil {
-			return ssh.ClientConfig{}, err
+			return ssh.ClientConfig{}, nil, err
+		}
+
+		privateKey, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return ssh.ClientConfig{}, nil, err
 		}
 
+		authMethods = append(authMethods, ssh.PublicKeys(privateKey))
+	}
+
+	for _, key := range auth.RawKeys {
 		privateKey, err := ssh.ParsePrivateKey(key)
 		if err != nil {
-			return ssh.ClientConfig{}, err
+			return ssh.ClientConfig{}, nil, err
 		}
 
 		authMethods = append(authMethods, ssh.PublicKeys(privateKey))
@@ -94,42 +133,28 @@ func NewNativeConfig(user string, auth *Auth) (ssh.ClientConfig, error) {
 		authMethods = append(authMethods, ssh.Password(p))
 	}
 
-	return ssh.ClientConfig{
-		User:            user,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}, nil
-}
-
-func (client *NativeClient) Wait() error {
-	err := client.openSession.Wait()
+	callback, tofu, err := hostKeyCallback(auth)
 	if err != nil {
-		return err
+		return ssh.ClientConfig{}, nil, err
 	}
 
-	_ = client.openSession.Close()
-
-	err = client.openClient.Close()
-	if err != nil {
-		return err
+	config := ssh.ClientConfig{
+		User:            user,
+		Auth:            authMethods,
+		HostKeyCallback: callback,
+		Timeout:         dialTimeout,
 	}
-
-	client.openSession = nil
-	client.openClient = nil
-	return nil
+	if len(auth.HostCAs) > 0 {
+		config.HostKeyAlgorithms = certAlgorithms
+	}
+	return config, tofu, nil
 }
 
 func (client *NativeClient) Shell(args ...string) error {
 	var (
 		termWidth, termHeight int
 	)
-	conn, err := ssh.Dial("tcp", net.JoinHostPort(client.Hostname, strconv.Itoa(client.Port)), &client.Config)
-	if err != nil {
-		return err
-	}
-	defer closeConn(conn)
-
-	session, err := conn.NewSession()
+	session, err := client.session(context.Background())
 	if err != nil {
 		return err
 	}
@@ -183,96 +208,180 @@ func (client *NativeClient) Shell(args ...string) error {
 	return nil
 }
 
-func (client *NativeClient) Start(command string) (io.ReadCloser, io.ReadCloser, error) {
-	conn, session, err := client.session(command)
-	if err != nil {
-		return nil, nil, err
-	}
+func (client *NativeClient) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	return client.run(ctx, command, stdout, stderr)
+}
 
-	stdout, err := session.StdoutPipe()
-	if err != nil {
-		return nil, nil, err
-	}
-	stderr, err := session.StderrPipe()
+// run runs the command in a new session, until it exits or ctx is done
+func (client *NativeClient) run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	session, err := client.session(ctx)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
 	if err := session.Start(command); err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	client.openClient = conn
-	client.openSession = session
-	return ioutil.NopCloser(stdout), ioutil.NopCloser(stderr), nil
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		log.Debug().Str("command", command).Msg("Stopping remote command")
+		if err := session.Signal(ssh.SIGKILL); err != nil {
+			log.Debug().Err(err).Msg("Error signaling remote command")
+		}
+		return ctx.Err()
+	}
 }
 
-func (client *NativeClient) Output(command string) (string, error) {
-	conn, session, err := client.session(command)
+// dial connects to the machine, giving up when ctx is done or the handshake
+// takes longer than the timeout of the config
+func (client *NativeClient) dial(ctx context.Context) (*ssh.Client, error) {
+	addr := net.JoinHostPort(client.Hostname, strconv.Itoa(client.Port))
+	dialer := net.Dialer{Timeout: client.Config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		return "", nil
+		return nil, err
 	}
-	defer closeConn(conn)
-	defer session.Close()
 
-	output, err := session.CombinedOutput(command)
-
-	return string(output), err
+	var deadline time.Time
+	if client.Config.Timeout > 0 {
+		deadline = time.Now().Add(client.Config.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &client.Config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func (client *NativeClient) OutputWithPty(command string) (string, error) {
-	conn, session, err := client.session(command)
+// connect returns the connection to the machine, dialing it if we are not
+// connected, until ctx is done. The connection is kept alive until Close.
+func (client *NativeClient) connect(ctx context.Context) (*ssh.Client, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.conn != nil {
+		return client.conn, nil
+	}
+
+	var conn *ssh.Client
+	err := wait.Until(ctx, "SSH connection", dialWait, func(ctx context.Context) error {
+		c, err := client.dial(ctx)
+		if err != nil {
+			return err
+		}
+		conn = c
+		return nil
+	})
 	if err != nil {
-		return "", nil
+		return nil, fmt.Errorf("error attempting SSH client dial: %w", err)
 	}
-	defer closeConn(conn)
-	defer session.Close()
 
-	fd := int(os.Stdout.Fd())
+	client.tofu.pin()
+	client.conn = conn
+	go client.keepAlive(conn)
+	return conn, nil
+}
 
-	termWidth, termHeight, err := terminal.GetSize(fd)
+// session opens a new session over the connection. If it fails, the machine
+// may have rebooted since we connected, so we connect again once.
+func (client *NativeClient) session(ctx context.Context) (*ssh.Session, error) {
+	conn, err := client.connect(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
+	session, err := conn.NewSession()
+	if err == nil {
+		return session, nil
 	}
 
-	// request tty -- fixes error with hosts that use
-	// "Defaults requiretty" in /etc/sudoers - I'm looking at you RedHat
-	if err := session.RequestPty("xterm", termHeight, termWidth, modes); err != nil {
-		return "", err
+	log.Debug().Err(err).Msg("Error opening SSH session, reconnecting")
+	client.drop(conn)
+
+	conn, err = client.connect(ctx)
+	if err != nil {
+		return nil, err
 	}
+	return conn.NewSession()
+}
 
-	output, err := session.CombinedOutput(command)
+// keepAlive pings the machine until the connection is closed, dropping the
+// connection when the machine stops answering
+func (client *NativeClient) keepAlive(conn *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
 
-	return string(output), err
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+			log.Debug().Err(err).Msg("SSH keepalive failed")
+		case <-time.After(keepAliveTimeout):
+			log.Debug().Msg("SSH keepalive timed out")
+		}
+		client.drop(conn)
+		return
+	}
 }
 
-func (client *NativeClient) dialSuccess() bool {
-	conn, err := ssh.Dial("tcp", net.JoinHostPort(client.Hostname, strconv.Itoa(client.Port)), &client.Config)
-	if err != nil {
-		log.Debug().Err(err).Msg("Error dialing TCP")
-		return false
+// drop forgets conn, if it is still the current connection, and closes it
+func (client *NativeClient) drop(conn *ssh.Client) {
+	client.mu.Lock()
+	if client.conn == conn {
+		client.conn = nil
 	}
+	client.mu.Unlock()
+
 	closeConn(conn)
-	return true
 }
 
-func (client *NativeClient) session(command string) (*ssh.Client, *ssh.Session, error) {
-	if err := mcnutils.WaitFor(client.dialSuccess); err != nil {
-		return nil, nil, fmt.Errorf("error attempting SSH client dial: %s", err)
-	}
+func (client *NativeClient) Close() error {
+	client.mu.Lock()
+	conn := client.conn
+	client.conn = nil
+	client.mu.Unlock()
 
-	conn, err := ssh.Dial("tcp", net.JoinHostPort(client.Hostname, strconv.Itoa(client.Port)), &client.Config)
-	if err != nil {
-		return nil, nil, fmt.Errorf("mysterious error dialing TCP for SSH (we already succeeded at least once) : %s", err)
+	if conn == nil {
+		return nil
 	}
-	session, err := conn.NewSession()
-
-	return conn, session, err
+	return conn.Close()
 }
 
 func closeConn(c io.Closer) {
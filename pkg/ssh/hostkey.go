@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	ErrHostKeyMismatch     = utils.Error("SSH host key does not match the one pinned when the machine was created")
+	ErrHostKeyNotCertified = utils.Error("SSH host key is not signed by a trusted CA")
+)
+
+// host key algorithms requested from the machines when we trust host CAs
+var certAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+}
+
+// trustOnFirstUse remembers the host key seen during the handshake. It is
+// only pinned once a connection authenticates, as the guest customization
+// may still regenerate the host keys while we wait for the machine. The
+// reconnections of the client must then present the pinned key.
+type trustOnFirstUse struct {
+	seen   string
+	pinned string
+	onPin  func(hostKey string)
+}
+
+func (t *trustOnFirstUse) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if t.pinned != "" {
+		if marshalHostKey(key) != t.pinned {
+			log.Error().
+				Str("host", hostname).
+				Str("got", ssh.FingerprintSHA256(key)).
+				Msg("SSH host key mismatch")
+			return ErrHostKeyMismatch
+		}
+		return nil
+	}
+
+	t.seen = marshalHostKey(key)
+	return nil
+}
+
+// pin trusts the host key of the last connection, and hands it to OnHostKey
+func (t *trustOnFirstUse) pin() {
+	if t == nil || t.pinned != "" || t.seen == "" {
+		return
+	}
+	log.Debug().Str("host_key", t.seen).Msg("Pinning SSH host key on first use")
+	t.pinned = t.seen
+	if t.onPin != nil {
+		t.onPin(t.pinned)
+	}
+}
+
+// hostKeyCallback verifies the host key of the machine against the CAs of
+// auth if there are any, or else against the pinned key. Without a pinned
+// key, the first one seen on an authenticated connection is trusted, see
+// trustOnFirstUse.
+func hostKeyCallback(auth *Auth) (ssh.HostKeyCallback, *trustOnFirstUse, error) {
+	if len(auth.HostCAs) > 0 {
+		cas := make([]ssh.PublicKey, 0, len(auth.HostCAs))
+		for _, ca := range auth.HostCAs {
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid host CA %q: %w", ca, err)
+			}
+			cas = append(cas, key)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return checkHostCert(key, cas)
+		}, nil, nil
+	}
+
+	if auth.HostKey != "" {
+		pinned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(auth.HostKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid pinned host key %q: %w", auth.HostKey, err)
+		}
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+				log.Error().
+					Str("host", hostname).
+					Str("expected", ssh.FingerprintSHA256(pinned)).
+					Str("got", ssh.FingerprintSHA256(key)).
+					Msg("SSH host key mismatch")
+				return ErrHostKeyMismatch
+			}
+			return nil
+		}, nil, nil
+	}
+
+	tofu := &trustOnFirstUse{onPin: auth.OnHostKey}
+	return tofu.callback, tofu, nil
+}
+
+// checkHostCert accepts host certificates signed by one of the CAs. The
+// principals are not checked, machines get their addresses when created.
+func checkHostCert(key ssh.PublicKey, cas []ssh.PublicKey) error {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.HostCert {
+		return ErrHostKeyNotCertified
+	}
+
+	trusted := false
+	for _, ca := range cas {
+		if bytes.Equal(cert.SignatureKey.Marshal(), ca.Marshal()) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return ErrHostKeyNotCertified
+	}
+
+	principal := ""
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	checker := ssh.CertChecker{}
+	return checker.CheckCert(principal, cert)
+}
+
+func marshalHostKey(key ssh.PublicKey) string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+}
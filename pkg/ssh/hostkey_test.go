@@ -0,0 +1,244 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testPassword = "secret"
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newHostCert returns the host key signed by ca
+func newHostCert(t *testing.T, hostKey, ca ssh.Signer) ssh.Signer {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// serve runs an SSH server presenting hostKey, accepting testPassword and
+// exiting 0 for every command. It returns its port.
+func serve(t *testing.T, hostKey ssh.Signer) int {
+	t.Helper()
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != testPassword {
+				return nil, ErrHostKeyMismatch // any error rejects the password
+			}
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, cfg)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func serveConn(conn net.Conn, cfg *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				_ = req.Reply(true, nil)
+				_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				channel.Close()
+			}
+		}()
+	}
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	hostKey := newSigner(t)
+	otherKey := newSigner(t)
+	ca := newSigner(t)
+	caKey := marshalHostKey(ca.PublicKey())
+
+	for _, tc := range []struct {
+		name       string
+		serverKey  ssh.Signer
+		auth       Auth
+		wantErr    string
+		wantPinned string
+	}{
+		{
+			name:      "pinned key accepted",
+			serverKey: hostKey,
+			auth:      Auth{HostKey: marshalHostKey(hostKey.PublicKey())},
+		},
+		{
+			name:      "changed key rejected",
+			serverKey: otherKey,
+			auth:      Auth{HostKey: marshalHostKey(hostKey.PublicKey())},
+			wantErr:   ErrHostKeyMismatch.Error(),
+		},
+		{
+			name:       "first key pinned after auth",
+			serverKey:  hostKey,
+			wantPinned: marshalHostKey(hostKey.PublicKey()),
+		},
+		{
+			name:      "unauthenticated handshake not pinned",
+			serverKey: hostKey,
+			auth:      Auth{Passwords: []string{"wrong"}},
+			wantErr:   "unable to authenticate",
+		},
+		{
+			name:      "certificate of a trusted CA accepted",
+			serverKey: newHostCert(t, hostKey, ca),
+			// the CAs take precedence over the pinned key
+			auth: Auth{HostCAs: []string{caKey}, HostKey: marshalHostKey(otherKey.PublicKey())},
+		},
+		{
+			name:      "certificate of another CA rejected",
+			serverKey: newHostCert(t, hostKey, otherKey),
+			auth:      Auth{HostCAs: []string{caKey}},
+			wantErr:   ErrHostKeyNotCertified.Error(),
+		},
+		{
+			// only certificates are asked for, so there is no common algorithm
+			name:      "plain key rejected with CAs",
+			serverKey: hostKey,
+			auth:      Auth{HostCAs: []string{caKey}, HostKey: marshalHostKey(hostKey.PublicKey())},
+			wantErr:   "no common algorithm for host key",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port := serve(t, tc.serverKey)
+
+			auth := tc.auth
+			if auth.Passwords == nil {
+				auth.Passwords = []string{testPassword}
+			}
+			pinned := ""
+			auth.OnHostKey = func(hostKey string) { pinned = hostKey }
+
+			c, err := NewNativeClient("root", "127.0.0.1", port, &auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := c.(*NativeClient)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			_, err = client.connect(ctx)
+			defer client.Close()
+
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("error = %v, want %q", err, tc.wantErr)
+			}
+			if pinned != tc.wantPinned {
+				t.Errorf("pinned %q, want %q", pinned, tc.wantPinned)
+			}
+		})
+	}
+}
+
+func TestPinnedKeyRequiredOnReconnect(t *testing.T) {
+	auth := Auth{Passwords: []string{testPassword}}
+	client, err := NewNativeClient("root", "127.0.0.1", serve(t, newSigner(t)), &auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native := client.(*NativeClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := native.Run(ctx, "exit", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the machine comes back with other host keys
+	native.Close()
+	native.Port = serve(t, newSigner(t))
+	if _, err := native.dial(ctx); err == nil || !strings.Contains(err.Error(), ErrHostKeyMismatch.Error()) {
+		t.Fatalf("error = %v, want a host key mismatch", err)
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	cfg, _, err := newNativeConfig("root", &Auth{HostCAs: []string{marshalHostKey(newSigner(t).PublicKey())}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algo := range cfg.HostKeyAlgorithms {
+		if !strings.Contains(algo, "-cert-") {
+			t.Errorf("plain host key algorithm %s requested with CAs", algo)
+		}
+	}
+	if len(cfg.HostKeyAlgorithms) == 0 {
+		t.Error("host key algorithms not restricted with CAs")
+	}
+
+	cfg, _, err = newNativeConfig("root", &Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HostKeyAlgorithms) != 0 {
+		t.Errorf("host key algorithms restricted without CAs: %v", cfg.HostKeyAlgorithms)
+	}
+}
@@ -0,0 +1,35 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// GenerateKeyPair creates an ed25519 key pair. It returns the private key
+// PEM encoded and the public key in authorized_keys format, without the
+// trailing newline.
+func GenerateKeyPair() (privateKey []byte, authorizedKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", err
+	}
+	privateKey = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	authorizedKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+
+	return privateKey, authorizedKey, nil
+}
@@ -0,0 +1,90 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog/log"
+)
+
+func (client *NativeClient) Upload(localPath, remotePath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	sftpClient, err := client.sftp()
+	if err != nil {
+		return err
+	}
+	defer closeConn(sftpClient)
+
+	log.Debug().Msgf("Uploading %s to %s:%s", localPath, client.Hostname, remotePath)
+
+	// SFTP paths always use forward slashes, even on Windows guests
+	if err := sftpClient.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+
+	dst, err := sftpClient.Create(remotePath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (client *NativeClient) Download(remotePath, localPath string) error {
+	sftpClient, err := client.sftp()
+	if err != nil {
+		return err
+	}
+	defer closeConn(sftpClient)
+
+	log.Debug().Msgf("Downloading %s:%s to %s", client.Hostname, remotePath, localPath)
+
+	src, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// sftp opens an SFTP session over the connection to the machine
+func (client *NativeClient) sftp() (*sftp.Client, error) {
+	conn, err := client.connect(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	sftpClient, err := sftp.NewClient(conn)
+	if err == nil {
+		return sftpClient, nil
+	}
+
+	// the machine may have rebooted since we connected
+	client.drop(conn)
+	if conn, err = client.connect(context.Background()); err != nil {
+		return nil, err
+	}
+	return sftp.NewClient(conn)
+}
@@ -0,0 +1,142 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+)
+
+const (
+	ErrStateNotFound = utils.Error("job state not found")
+)
+
+// JobState is what a driver learns about its machine during prepare. Every
+// stage of the custom executor runs as a separate process, so we keep it on
+// disk to avoid looking the machine up again in run, cleanup and shell.
+type JobState struct {
+	Driver        string    `json:"driver"`
+	MachineName   string    `json:"machine_name"`
+	VAppHREF      string    `json:"vapp_href,omitempty"`
+	VMHREF        string    `json:"vm_href,omitempty"`
+	ContainerID   string    `json:"container_id,omitempty"`
+	IP            string    `json:"ip,omitempty"`
+	SSHPort       int       `json:"ssh_port,omitempty"`
+	OS            string    `json:"os,omitempty"`
+	AdminPassword string    `json:"admin_password,omitempty"`
+	SSHPrivateKey string    `json:"ssh_private_key,omitempty"` // PEM
+	SSHHostKey    string    `json:"ssh_host_key,omitempty"`    // authorized_keys format
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Store persists the state of a single job as a JSON file in dir
+type Store struct {
+	dir   string
+	jobID string
+}
+
+func NewStore(dir string, jobID string) *Store {
+	return &Store{
+		dir:   dir,
+		jobID: jobID,
+	}
+}
+
+func (s *Store) Load() (*JobState, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(s.path())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrStateNotFound
+		}
+		return nil, err
+	}
+
+	st := JobState{}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("error decoding state of job %s: %w", s.jobID, err)
+	}
+	return &st, nil
+}
+
+func (s *Store) Save(st *JobState) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash never leaves a truncated state behind
+	tmp := s.path() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path())
+}
+
+func (s *Store) Delete() error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(s.path())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	// unlinking a locked file is fine, the job is over anyway. Windows
+	// refuses to remove open files, so it keeps them.
+	_ = os.Remove(s.lockPath())
+	return nil
+}
+
+func (s *Store) path() string {
+	return filepath.Join(s.dir, fmt.Sprintf("job-%s.json", s.jobID))
+}
+
+func (s *Store) lockPath() string {
+	return filepath.Join(s.dir, fmt.Sprintf("job-%s.lock", s.jobID))
+}
+
+// lock takes an exclusive lock on the job state, creating the state dir if needed
+func (s *Store) lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return nil, err
+	}
+	return Lock(s.lockPath())
+}
+
+// Lock takes an exclusive lock on path, shared with other gitlab-machine
+// processes. The returned function releases it.
+func Lock(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,161 @@
+package wait
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+)
+
+const (
+	ErrTimeout = utils.Error("timed out")
+)
+
+const (
+	backoffFactor = 2
+	jitterFactor  = 0.2
+
+	// how often we tell at info level that we are still waiting
+	progressInterval = time.Minute
+)
+
+// Config of a wait, settable in the wait section of the driver configs
+type Config struct {
+	// Timeout bounds the whole wait. Zero waits until the context is done.
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Interval is the delay after the first failed attempt. It doubles after
+	// every failed attempt, up to MaxInterval.
+	Interval    time.Duration `mapstructure:"interval"`
+	MaxInterval time.Duration `mapstructure:"max_interval"`
+	// Successes is how many attempts in a row must succeed, for conditions
+	// that need to be stable. Defaults to 1.
+	Successes int `mapstructure:"successes"`
+}
+
+// Configs are the waits of a driver, by name (ssh, rdp...)
+type Configs map[string]Config
+
+// Get returns the wait called name, with the unset fields taken from defaults
+func (c Configs) Get(name string, defaults Config) Config {
+	return c[name].WithDefaults(defaults)
+}
+
+// WithDefaults fills the unset fields of c from defaults
+func (c Config) WithDefaults(defaults Config) Config {
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = defaults.MaxInterval
+	}
+	if c.Successes == 0 {
+		c.Successes = defaults.Successes
+	}
+	return c
+}
+
+// Condition is met when it returns nil
+type Condition func(ctx context.Context) error
+
+// Until checks cond until it succeeds cfg.Successes times in a row, backing
+// off between failed attempts. It gives up when ctx is done or cfg.Timeout
+// elapses, returning an error wrapping ErrTimeout or the context error.
+func Until(ctx context.Context, name string, cfg Config, cond Condition) error {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+	if cfg.Successes < 1 {
+		cfg.Successes = 1
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+	if cfg.MaxInterval < cfg.Interval {
+		cfg.MaxInterval = cfg.Interval
+	}
+
+	start := time.Now()
+	lastProgress := start
+	interval := cfg.Interval
+	successes := 0
+	var lastErr error
+
+	for attempt := 1; ; attempt++ {
+		err := cond(ctx)
+		if err == nil {
+			successes++
+			log.Debug().
+				Str("wait", name).
+				Int("attempt", attempt).
+				Int("successes", successes).
+				Int("required", cfg.Successes).
+				Msg("Condition met")
+			if successes >= cfg.Successes {
+				return nil
+			}
+			// stable conditions are polled at a steady pace
+			interval = cfg.Interval
+		} else {
+			if successes > 0 {
+				log.Debug().Str("wait", name).Err(err).Msg("Condition no longer met, starting over")
+			}
+			successes = 0
+			lastErr = err
+			log.Debug().
+				Str("wait", name).
+				Int("attempt", attempt).
+				Dur("elapsed", time.Since(start)).
+				Err(err).
+				Msg("Condition not met yet")
+		}
+
+		if time.Since(lastProgress) >= progressInterval {
+			log.Info().
+				Str("wait", name).
+				Int("attempt", attempt).
+				Dur("elapsed", time.Since(start).Round(time.Second)).
+				Msgf("Still waiting for %s", name)
+			lastProgress = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return timeoutError(ctx, name, time.Since(start), lastErr)
+		case <-time.After(jitter(interval)):
+		}
+
+		if err != nil {
+			interval *= backoffFactor
+			if interval > cfg.MaxInterval {
+				interval = cfg.MaxInterval
+			}
+		}
+	}
+}
+
+func timeoutError(ctx context.Context, name string, elapsed time.Duration, lastErr error) error {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("waiting for %s: %w", name, ctx.Err())
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%w waiting for %s after %s: %v", ErrTimeout, name, elapsed.Round(time.Second), lastErr)
+	}
+	return fmt.Errorf("%w waiting for %s after %s", ErrTimeout, name, elapsed.Round(time.Second))
+}
+
+// jitter spreads d by ±jitterFactor, so machines created together do not
+// poll in lockstep
+func jitter(d time.Duration) time.Duration {
+	delta := float64(d) * jitterFactor
+	return d + time.Duration(delta*(2*rand.Float64()-1))
+}
@@ -0,0 +1,253 @@
+package winrm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masterzen/winrm"
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+	"github.com/juanfont/gitlab-machine/pkg/utils"
+	"github.com/juanfont/gitlab-machine/pkg/wait"
+)
+
+const (
+	ErrUnencrypted = utils.Error("WinRM without https sends commands and passwords in the clear, set allow_unencrypted to accept it")
+)
+
+const (
+	Port      = 5985
+	HTTPSPort = 5986
+
+	operationTimeout = 60 * time.Second
+)
+
+// shellWait is how long the WinRM service gets to accept shells again, as it
+// refuses them while it restarts or when the user has too many open. The
+// first boot is waited for by the drivers.
+var shellWait = wait.Config{
+	Timeout:     3 * time.Minute,
+	Interval:    time.Second,
+	MaxInterval: 10 * time.Second,
+}
+
+// Config of the WinRM listener of the guests
+type Config struct {
+	// Port defaults to 5985, or 5986 with HTTPS
+	Port  int  `mapstructure:"port"`
+	HTTPS bool `mapstructure:"https"`
+	// Insecure skips the verification of the certificate of the listener
+	Insecure bool `mapstructure:"insecure"`
+	// CACert is the path to the PEM CA the listener certificate is checked with
+	CACert string `mapstructure:"ca_cert"`
+	// NTLM authenticates with NTLM instead of basic auth. It does not
+	// encrypt the messages, only HTTPS does.
+	NTLM bool `mapstructure:"ntlm"`
+	// AllowUnencrypted accepts talking to the listener over plain HTTP
+	AllowUnencrypted bool `mapstructure:"allow_unencrypted"`
+}
+
+// Validate rejects plain HTTP unless it is explicitly allowed
+func (c Config) Validate() error {
+	if !c.HTTPS && !c.AllowUnencrypted {
+		return ErrUnencrypted
+	}
+	return nil
+}
+
+// GuestPort returns the port the listener uses in the guest
+func (c Config) GuestPort() int {
+	if c.Port != 0 {
+		return c.Port
+	}
+	if c.HTTPS {
+		return HTTPSPort
+	}
+	return Port
+}
+
+// ExitError is returned when the remote command exits with a non-zero status
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+func (e *ExitError) ExitStatus() int {
+	return e.Status
+}
+
+var _ communicator.Communicator = (*Client)(nil)
+
+// Client runs commands on Windows guests over WinRM. Commands run in
+// PowerShell, like over SSH once it is the default shell of OpenSSH.
+type Client struct {
+	Hostname string
+	Port     int
+	client   *winrm.Client
+}
+
+// NewClient returns a client for the listener at host:port. It does not
+// connect until the first command.
+func NewClient(user, password, host string, port int, cfg Config) (*Client, error) {
+	log.Debug().Msgf("Creating WinRM client for %s@%s:%d", user, host, port)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var caCert []byte
+	if cfg.CACert != "" {
+		var err error
+		caCert, err = ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := winrm.NewEndpoint(host, port, cfg.HTTPS, cfg.Insecure, caCert, nil, nil, operationTimeout)
+
+	params := *winrm.DefaultParameters
+	if cfg.NTLM {
+		params.TransportDecorator = func() winrm.Transporter { return &winrm.ClientNTLM{} }
+	}
+
+	client, err := winrm.NewClientWithParameters(endpoint, user, password, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		Hostname: host,
+		Port:     port,
+		client:   client,
+	}, nil
+}
+
+// powershell wraps command so it runs in PowerShell, exiting with the exit
+// code of the last native command, or 1 if the last cmdlet failed
+func powershell(command string) string {
+	return winrm.Powershell(command + "\nif (-not $?) { if ($LASTEXITCODE) { exit $LASTEXITCODE }; exit 1 }")
+}
+
+// shell opens a new remote shell, retrying for a while, as the machine may
+// be rebooting
+func (c *Client) shell(ctx context.Context) (*winrm.Shell, error) {
+	var shell *winrm.Shell
+	err := wait.Until(ctx, "WinRM shell", shellWait, func(ctx context.Context) error {
+		s, err := c.client.CreateShell()
+		if err != nil {
+			return err
+		}
+		shell = s
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error opening WinRM shell: %w", err)
+	}
+	return shell, nil
+}
+
+func (c *Client) Run(ctx context.Context, command string, stdout, stderr io.Writer) error {
+	return c.run(ctx, powershell(command), nil, stdout, stderr)
+}
+
+// Shell runs the command, or PowerShell without one, with our standard
+// input. There is no terminal, so there is no line editing either.
+func (c *Client) Shell(args ...string) error {
+	command := "powershell -NoLogo"
+	if len(args) > 0 {
+		command = powershell(strings.Join(args, " "))
+	}
+	return c.run(context.Background(), command, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// run runs the command in a new shell, until it exits or ctx is done
+func (c *Client) run(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	shell, err := c.shell(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeShell(shell)
+
+	cmd, err := shell.Execute(command)
+	if err != nil {
+		return err
+	}
+
+	if stdin != nil {
+		go func() {
+			_, _ = io.Copy(cmd.Stdin, stdin)
+			cmd.Stdin.Close()
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- waitCommand(cmd, stdout, stderr)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		log.Debug().Str("command", command).Msg("Stopping remote command")
+		if err := cmd.Close(); err != nil {
+			log.Debug().Err(err).Msg("Error stopping remote command")
+		}
+		return ctx.Err()
+	}
+}
+
+// waitCommand copies the output of cmd until it exits. Errors reading the
+// output mean we lost the machine, not that the command failed.
+func waitCommand(cmd *winrm.Command, stdout, stderr io.Writer) error {
+	var (
+		wg                   sync.WaitGroup
+		stdoutErr, stderrErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, stdoutErr = io.Copy(stdout, cmd.Stdout)
+	}()
+	go func() {
+		defer wg.Done()
+		_, stderrErr = io.Copy(stderr, cmd.Stderr)
+	}()
+
+	cmd.Wait()
+	wg.Wait()
+	_ = cmd.Close()
+
+	if stdoutErr != nil {
+		return stdoutErr
+	}
+	if stderrErr != nil {
+		return stderrErr
+	}
+	if code := cmd.ExitCode(); code != 0 {
+		return &ExitError{Status: code}
+	}
+	return nil
+}
+
+// Close does nothing, every command opens its own shell over HTTP
+func (c *Client) Close() error {
+	return nil
+}
+
+func closeShell(shell *winrm.Shell) {
+	if err := shell.Close(); err != nil {
+		log.Debug().Err(err).Msg("Error closing WinRM shell")
+	}
+}
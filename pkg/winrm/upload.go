@@ -0,0 +1,101 @@
+package winrm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/juanfont/gitlab-machine/pkg/communicator"
+)
+
+// uploadChunkSize keeps the echo commands under the 8191 characters limit
+// of cmd.exe
+const uploadChunkSize = 6000
+
+// Upload copies the local file to remotePath, creating the parent
+// directories if needed. WinRM cannot transfer files, so the file is
+// appended base64 encoded to a temporary file, and decoded at the end.
+func (c *Client) Upload(localPath, remotePath string) error {
+	content, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msgf("Uploading %s to %s:%s", localPath, c.Hostname, remotePath)
+
+	dst := windowsPath(remotePath)
+	tmp := dst + ".b64"
+
+	prepare := fmt.Sprintf(
+		"New-Item -ItemType Directory -Force -Path '%s' | Out-Null; New-Item -ItemType File -Force -Path '%s' | Out-Null",
+		windowsPath(path.Dir(remotePath)), tmp,
+	)
+	if _, err := communicator.Output(context.Background(), c, prepare); err != nil {
+		return fmt.Errorf("error preparing the upload of %s: %w", remotePath, err)
+	}
+
+	// one shell for every chunk, opening them is slow
+	shell, err := c.shell(context.Background())
+	if err != nil {
+		return err
+	}
+	defer closeShell(shell)
+
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 0 {
+		n := uploadChunkSize
+		if n > len(encoded) {
+			n = len(encoded)
+		}
+
+		cmd, err := shell.Execute(fmt.Sprintf(`echo %s>> "%s"`, encoded[:n], tmp))
+		if err != nil {
+			return err
+		}
+		if err := waitCommand(cmd, ioutil.Discard, ioutil.Discard); err != nil {
+			return fmt.Errorf("error uploading %s: %w", remotePath, err)
+		}
+		encoded = encoded[n:]
+	}
+
+	decode := fmt.Sprintf(
+		"$b64 = [IO.File]::ReadAllText('%[1]s') -replace '\\s', ''; "+
+			"[IO.File]::WriteAllBytes('%[2]s', [Convert]::FromBase64String($b64)); "+
+			"Remove-Item -Force '%[1]s'",
+		tmp, dst,
+	)
+	if _, err := communicator.Output(context.Background(), c, decode); err != nil {
+		return fmt.Errorf("error decoding the upload of %s: %w", remotePath, err)
+	}
+	return nil
+}
+
+// Download copies the remote file to localPath, base64 encoded in the
+// output of PowerShell
+func (c *Client) Download(remotePath, localPath string) error {
+	log.Debug().Msgf("Downloading %s:%s to %s", c.Hostname, remotePath, localPath)
+
+	var encoded bytes.Buffer
+	command := fmt.Sprintf("[Convert]::ToBase64String([IO.File]::ReadAllBytes('%s'))", windowsPath(remotePath))
+	if err := c.Run(context.Background(), command, &encoded, ioutil.Discard); err != nil {
+		return fmt.Errorf("error downloading %s: %w", remotePath, err)
+	}
+
+	content, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded.String()))
+	if err != nil {
+		return fmt.Errorf("error decoding the download of %s: %w", remotePath, err)
+	}
+	return ioutil.WriteFile(localPath, content, 0o644)
+}
+
+// windowsPath turns the forward slashes we use for remote paths into
+// backslashes, cmd.exe does not like the former
+func windowsPath(p string) string {
+	return strings.ReplaceAll(p, "/", `\`)
+}